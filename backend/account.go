@@ -0,0 +1,277 @@
+package backend
+
+import (
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"google.golang.org/api/googleapi"
+)
+
+// Drive keeps the health of each of its accounts: its storage quota, what it
+// uploaded since the start of its day (Google refuses uploads past
+// DAILY_UPLOAD_LIMIT a day), and the errors it got. A rate limited account is
+// skipped for a backoff doubling from BACKOFF_MIN to BACKOFF_MAX, one which
+// hit a daily limit until its day ends, a full one for uploads for
+// QUOTA_REFRESH, and one whose token is refused for AUTH_RETRY. Uploads still
+// rate limited once the backoff is at BACKOFF_MAX are taken for the daily
+// upload limit, which Google reports as userRateLimitExceeded too. This is
+// kept in ACCOUNTS_FILE.
+const ACCOUNTS_FILE = "drive_accounts"
+const DAILY_UPLOAD_LIMIT = 750 << 30
+const BACKOFF_MIN = 1 * time.Second
+const BACKOFF_MAX = 10 * time.Minute
+const QUOTA_REFRESH = 1 * time.Hour
+const AUTH_RETRY = 1 * time.Hour
+
+type account struct {
+	Email string
+	Total, Usage uint64
+	QuotaTime time.Time
+	DayStart time.Time
+	DayUploaded uint64
+	RateLimits int
+	// skipped until Until, and for uploads until UploadUntil
+	Until, UploadUntil time.Time
+	Backoff time.Duration
+	LastError string
+	LastErrorTime time.Time
+}
+
+// newDay starts a new day for a if the last one is over.
+func (a *account) newDay(now time.Time) {
+	if now.Sub(a.DayStart) >= 24 * time.Hour {
+		a.DayStart = now
+		a.DayUploaded = 0
+		a.RateLimits = 0
+	}
+}
+
+// readyAt returns when a can be used, for an upload of size bytes if up, a
+// time not after now if it can be now.
+func (a *account) readyAt(up bool, size uint64) time.Time {
+	now := time.Now()
+	a.newDay(now)
+	res := now
+	later := func(t time.Time) {
+		if t.After(res) {
+			res = t
+		}
+	}
+	later(a.Until)
+	if !up {
+		return res
+	}
+	later(a.UploadUntil)
+	if a.DayUploaded + size > DAILY_UPLOAD_LIMIT {
+		later(a.DayStart.Add(24 * time.Hour))
+	}
+	// the usage is only trusted for a while, other programs may free room
+	if a.Total > 0 && a.Usage + size > a.Total {
+		later(a.QuotaTime.Add(QUOTA_REFRESH))
+	}
+	return res
+}
+
+// ready tells if a can be used now, for an upload of size bytes if up.
+func (a *account) ready(up bool, size uint64) bool {
+	return !a.readyAt(up, size).After(time.Now())
+}
+
+func errorReason(err error) (int, string) {
+	if e, ok := err.(*googleapi.Error); ok {
+		if len(e.Errors) > 0 {
+			return e.Code, e.Errors[0].Reason
+		}
+		return e.Code, ""
+	}
+	if strings.Contains(err.Error(), "invalid_grant") {
+		return http.StatusUnauthorized, "invalid_grant"
+	}
+	return 0, ""
+}
+
+// check records the result of a call with account sid, an upload if up, and
+// returns err.
+func (d *Drive) check(sid int, up bool, err error) error {
+	d.serviceMutex.Lock()
+	defer d.serviceMutex.Unlock()
+	a := &d.accounts[sid]
+	now := time.Now()
+	a.newDay(now)
+	if err == nil {
+		a.Backoff = 0
+		return nil
+	}
+	code, reason := errorReason(err)
+	switch {
+	case reason == "userRateLimitExceeded" || reason == "rateLimitExceeded" || code == http.StatusTooManyRequests:
+		a.RateLimits++
+		if up && a.Backoff >= BACKOFF_MAX {
+			a.UploadUntil = a.DayStart.Add(24 * time.Hour)
+			a.Backoff = 0
+			log.Print("drive: account ", sid, " is out of daily uploads until ", a.UploadUntil.Format(time.Stamp))
+			break
+		}
+		if a.Backoff == 0 {
+			a.Backoff = BACKOFF_MIN
+		} else if a.Backoff < BACKOFF_MAX {
+			a.Backoff *= 2
+			if a.Backoff > BACKOFF_MAX {
+				a.Backoff = BACKOFF_MAX
+			}
+		}
+		a.Until = now.Add(a.Backoff)
+	case reason == "dailyLimitExceeded":
+		a.Until = a.DayStart.Add(24 * time.Hour)
+	case reason == "storageQuotaExceeded" || reason == "teamDriveFileLimitExceeded":
+		a.UploadUntil = now.Add(QUOTA_REFRESH)
+	case code == http.StatusUnauthorized:
+		a.Until = now.Add(AUTH_RETRY)
+	default:
+		// not found, network... not about the account
+		return err
+	}
+	a.LastError = err.Error()
+	a.LastErrorTime = now
+	return err
+}
+
+// uploaded counts n bytes uploaded with account sid.
+func (d *Drive) uploaded(sid int, n uint64) {
+	d.serviceMutex.Lock()
+	a := &d.accounts[sid]
+	a.newDay(time.Now())
+	a.DayUploaded += n
+	a.Usage += n
+	d.serviceMutex.Unlock()
+	d.saveAccounts()
+}
+
+// ready tells if account sid can be used now, for an upload of size bytes
+// if up.
+func (d *Drive) ready(sid int, up bool, size uint64) bool {
+	d.serviceMutex.Lock()
+	defer d.serviceMutex.Unlock()
+	return d.accounts[sid].ready(up, size)
+}
+
+// readyAt returns when account sid can be used, for an upload of size bytes
+// if up.
+func (d *Drive) readyAt(sid int, up bool, size uint64) time.Time {
+	d.serviceMutex.Lock()
+	defer d.serviceMutex.Unlock()
+	return d.accounts[sid].readyAt(up, size)
+}
+
+func (d *Drive) loadAccounts() {
+	d.accounts = make([]account, 0)
+	f, err := os.Open(ACCOUNTS_FILE)
+	if err == nil {
+		dec := gob.NewDecoder(f)
+		err = dec.Decode(&d.accounts)
+		f.Close()
+		if err != nil {
+			log.Print(err)
+			d.accounts = make([]account, 0)
+		}
+	}
+	for len(d.accounts) < len(d.services) {
+		d.accounts = append(d.accounts, account{})
+	}
+}
+
+// saveAccounts writes ACCOUNTS_FILE, one upload at a time, so that an older
+// state can't replace a newer one.
+func (d *Drive) saveAccounts() {
+	d.accountsMutex.Lock()
+	defer d.accountsMutex.Unlock()
+	d.serviceMutex.Lock()
+	t := make([]account, len(d.accounts))
+	copy(t, d.accounts)
+	d.serviceMutex.Unlock()
+	f, err := ioutil.TempFile(filepath.Dir(ACCOUNTS_FILE), filepath.Base(ACCOUNTS_FILE) + ".tmp")
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	err = gob.NewEncoder(f).Encode(t)
+	f.Close()
+	if err == nil {
+		err = os.Rename(f.Name(), ACCOUNTS_FILE)
+	}
+	if err != nil {
+		os.Remove(f.Name())
+		log.Print(err)
+	}
+}
+
+// setQuota records the storage quota of account sid.
+func (d *Drive) setQuota(sid int, total, usage uint64) {
+	d.serviceMutex.Lock()
+	a := &d.accounts[sid]
+	a.Total = total
+	a.Usage = usage
+	a.QuotaTime = time.Now()
+	d.serviceMutex.Unlock()
+}
+
+func sizeString(n uint64) string {
+	units := []string{"B", "KiB", "MiB", "GiB", "TiB", "PiB"}
+	x := float64(n)
+	i := 0
+	for x >= 1024 && i + 1 < len(units) {
+		x /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f %s", x, units[i])
+}
+
+// AccountStatus asks every account its quota again, and describes them.
+func (d *Drive) AccountStatus() []string {
+	for sid := range d.services {
+		r, err := d.services[sid].About.Get().Fields("user", "storageQuota").Do()
+		if d.check(sid, false, err) != nil {
+			continue
+		}
+		d.setQuota(sid, uint64(r.StorageQuota.Limit), uint64(r.StorageQuota.Usage))
+		if r.User != nil {
+			d.serviceMutex.Lock()
+			d.accounts[sid].Email = r.User.EmailAddress
+			d.serviceMutex.Unlock()
+		}
+	}
+	d.saveAccounts()
+	d.serviceMutex.Lock()
+	defer d.serviceMutex.Unlock()
+	res := make([]string, 0)
+	now := time.Now()
+	for sid := range d.services {
+		a := &d.accounts[sid]
+		a.newDay(now)
+		state := "ok"
+		if now.Before(a.Until) {
+			state = "skipped until " + a.Until.Format(time.Stamp)
+		} else if now.Before(a.UploadUntil) {
+			state = "no uploads until " + a.UploadUntil.Format(time.Stamp)
+		} else if !a.ready(true, 0) {
+			state = "no uploads"
+		}
+		quota := sizeString(a.Usage) + " used"
+		if a.Total > 0 {
+			quota += " of " + sizeString(a.Total)
+		}
+		s := fmt.Sprintf("%d %s: %s, %s, %s uploaded today, %d rate limits today", sid, a.Email, state, quota, sizeString(a.DayUploaded), a.RateLimits)
+		if a.LastError != "" {
+			s += ", last error at " + a.LastErrorTime.Format(time.Stamp) + ": " + a.LastError
+		}
+		res = append(res, s)
+	}
+	return res
+}
@@ -1,366 +1,274 @@
 package backend
 
 import (
-	"context"
-	"encoding/json"
+	"bytes"
+	"errors"
 	"fmt"
-	"golang.org/x/oauth2"
-	"golang.org/x/oauth2/google"
-	"google.golang.org/api/drive/v3"
 	"io"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"os"
-	"time"
-	"encoding/gob"
-	_ "bytes"
-	"math/rand"
 	"strings"
 	"sync"
+	"time"
 )
 
-const CONFIG_FILE = "drive_credentials"
-const TOKEN_FILE = "drive_tokens"
-const DIRMAP_FILE = "drive_dirmap"
-const ROOT_FOLDER = "your root folder id"
-
-func getConfig() *oauth2.Config {
-	b, err := ioutil.ReadFile(CONFIG_FILE)
-	if err != nil {
-		return nil
-	}
-	config, err := google.ConfigFromJSON(b, drive.DriveFileScope)
-	if err != nil {
-		return nil
-	}
-	return config
+// Object is a block as seen on the remote.
+type Object struct {
+	Source string
+	Name string
+	Size uint64
 }
 
-func getService(config *oauth2.Config, token *oauth2.Token) *drive.Service {
-	tr := &http.Transport{
-		MaxIdleConns: 200,
-		MaxIdleConnsPerHost: 200,
-	}
-	tclient := &http.Client{Transport: tr}
-	client := config.Client(context.WithValue(context.Background(), oauth2.HTTPClient, tclient), token)
-	service, err := drive.New(client)
-	if err != nil {
-		return nil
-	}
-	return service
+// Backend is a remote store of blocks. The source string returned by
+// Upload is saved in the node and handed back to the other methods as is.
+type Backend interface {
+	Load()
+	Save()
+	Upload(src, name string) (string, error)
+	Download(source string, writer io.Writer) error
+	DownloadRange(source string, offset, length uint64, writer io.Writer) error
+	Delete(source string) error
+	List() ([]Object, error)
+	Stat(source string) (Object, error)
+	Wait()
 }
 
-func bytesToToken(s []byte) *oauth2.Token {
-	tok := &oauth2.Token{}
-	err := json.Unmarshal(s, tok)
-	if err != nil {
-		return nil
-	}
-	return tok
+// Quota is implemented by backends which can tell how much room they have.
+// It returns the total and used bytes over every account, total being 0 when
+// there is no limit.
+type Quota interface {
+	Quota() (total, used uint64, err error)
 }
 
-func tokenToBytes(token *oauth2.Token) []byte {
-	s, err := json.Marshal(token)
-	if err != nil {
-		return nil
-	}
-	return s
+// MetaStore is implemented by backends which can keep copies of fs_data
+// apart from the blocks, in META_DIR. List skips them.
+type MetaStore interface {
+	PutMeta(name string, data []byte) error
+	GetMeta(name string) ([]byte, error)
+	ListMeta() ([]string, error)
+	DeleteMeta(name string) error
 }
 
-func createDir(service *drive.Service, name string, parentId string) (string, error) {
-	d := &drive.File{
-		Name: name,
-		MimeType: "application/vnd.google-apps.folder",
-		Parents: []string{parentId},
-	}
+const META_DIR = "meta/"
 
-	file, err := service.Files.Create(d).SupportsTeamDrives(true).Do()
+// DirCache is implemented by backends which keep the ids of their folders
+// locally. RebuildDirs lists them again from the remote, Save keeps them.
+type DirCache interface {
+	RebuildDirs() error
+}
 
-	if err != nil {
-		return "", err
-	}
+// Replicator is implemented by backends which can put copies of a block on
+// different accounts or backends. UploadReplicas uploads src up to n times,
+// each time to another one, and returns the sources of the copies made,
+// failing only if none could be. avoid are copies there already are, no new
+// one goes to their accounts or backends.
+type Replicator interface {
+	UploadReplicas(src, name string, n int, avoid []string) ([]string, error)
+}
 
-	return file.Id, err
+// Spreader is implemented by backends which can put different files on
+// different accounts or backends. UploadSpread uploads each of srcs with
+// another one, as long as there are enough, and returns their sources, ""
+// for those which failed. Spread tells how many accounts or backends there
+// are to spread over.
+type Spreader interface {
+	UploadSpread(srcs, names []string) []string
+	Spread() int
 }
 
-func createFile(service *drive.Service, name string, mimeType string, content io.Reader, parentId string) (string, error) {
-	f := &drive.File{
-		MimeType: mimeType,
-		Name: name,
-		Parents: []string{parentId},
-	}
+// Prioritizer is implemented by backends which schedule their transfers.
+// Downloads waiting for a slot go by prio, PRIO_READ first, and those made
+// with Download and DownloadRange are PRIO_READ.
+type Prioritizer interface {
+	DownloadPrio(source string, writer io.Writer, prio int) error
+	DownloadRangePrio(source string, offset, length uint64, writer io.Writer, prio int) error
+}
 
-	fmt.Println("start create######################")
-	file, err := service.Files.Create(f).Media(content).SupportsTeamDrives(true).Do()
-	fmt.Println("end create========================")
+// Accounts is implemented by backends which spread the transfers over
+// several accounts. AccountStatus describes each of them, one line each.
+type Accounts interface {
+	AccountStatus() []string
+}
 
-	if err != nil {
-		return "", err
-	}
+var backends = make(map[string]func() Backend)
 
-	return file.Id, err
+func register(name string, f func() Backend) {
+	backends[name] = f
 }
 
-func createDirF(service *drive.Service, name string, parentId string) string {
-	for true {
-		res, err := createDir(service, name, parentId)
-		if err != nil {
-			fmt.Println(err)
-		} else {
-			return res
-		}
-		time.Sleep(1 * time.Second)
+// New makes the backend name, or a Multi of the backends in it separated by
+// commas.
+func New(name string) Backend {
+	if strings.Contains(name, ",") {
+		return newMulti(strings.Split(name, ","))
 	}
-	return ""
+	f, ok := backends[name]
+	if !ok {
+		log.Fatal("unknown backend: ", name)
+	}
+	return f()
 }
 
-func uploadFileF(service *drive.Service, name string, src string, parentId string) string {
-	for true {
-		f, err := os.Open(src)
-		if err != nil {
-			fmt.Println(err)
-			continue
-		}
-		res, err := createFile(service, name, "application/octet-stream", f, parentId)
-		defer f.Close()
-		if err != nil {
-			fmt.Println(err)
-		} else {
-			return res
-		}
-		time.Sleep(1 * time.Second)
-	}
-	return ""
+// running counts the transfers in flight, so that Wait can block until
+// they are all done.
+type running struct {
+	n int
+	mutex sync.Mutex
+	idle *sync.Cond
 }
 
-func downloadFile(service *drive.Service, id string, writer io.Writer) error {
-	//fmt.Println(id)
-	req, err := service.Files.Get(id).SupportsTeamDrives(true).Download()
-	if err != nil {
-		return err
-	}
-	io.Copy(writer, req.Body)
-	return nil
+func (r *running) begin() {
+	r.mutex.Lock()
+	r.n++
+	r.mutex.Unlock()
 }
 
-func downloadFileF(service *drive.Service, id string, dst string) {
-	for true {
-		f, err := os.Create(dst)
-		if err != nil {
-			return
-		}
-		err = downloadFile(service, id, f)
-		f.Close()
-		if err != nil {
-			fmt.Println(err)
-		} else {
-			return
-		}
-		time.Sleep(1 * time.Second)
+func (r *running) end() {
+	r.mutex.Lock()
+	r.n--
+	if r.n == 0 && r.idle != nil {
+		r.idle.Broadcast()
 	}
+	r.mutex.Unlock()
 }
 
-func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
-	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
-	authURL = strings.Replace(authURL, "drive.file", "drive", -1)
-	fmt.Printf("Go to the following link in your browser then type the authorization code: \n%v\n", authURL)
-
-	var authCode string
-	if _, err := fmt.Scan(&authCode); err != nil {
-		log.Fatalf("Unable to read authorization code %v", err)
+func (r *running) Wait() {
+	r.mutex.Lock()
+	if r.idle == nil {
+		r.idle = sync.NewCond(&r.mutex)
 	}
-
-	tok, err := config.Exchange(context.TODO(), authCode)
-	if err != nil {
-		log.Fatalf("Unable to retrieve token from web %v", err)
+	for r.n > 0 {
+		r.idle.Wait()
 	}
-	return tok
+	r.mutex.Unlock()
 }
 
-var config *oauth2.Config
-var services []*drive.Service
-var dirMap map[string]string
-var servicesUsed []bool
-var serviceMutex, dirMutex sync.Mutex
+// ErrNotFound is returned by Delete for a block which is already gone.
+var ErrNotFound = errors.New("not found")
 
-func Save() {
-	f, err := os.Create(DIRMAP_FILE)
-	if err != nil {
-		log.Fatal(err)
-	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	err = enc.Encode(dirMap)
-	if err != nil {
-		log.Fatal(err)
-	}
-	fmt.Println("drive save ok")
+func randstr() string {
+	return fmt.Sprintf("%02x", rand.Intn(256))
 }
 
-func Load() {
-	rand.Seed(time.Now().UnixNano())
-	config = getConfig()
-	if config == nil {
-		log.Fatal("read config failed")
+func sourceId(source string) string {
+	pos := strings.Index(source, "|")
+	if pos == -1 {
+		return source
 	}
-	f, err := os.Open(DIRMAP_FILE)
-	if err != nil {
-		log.Print(err)
-		dirMap = make(map[string]string)
-	} else {
-		dec := gob.NewDecoder(f)
-		err = dec.Decode(&dirMap)
-		f.Close()
-	}
-	f, err = os.Open(TOKEN_FILE)
-	services = make([]*drive.Service, 0)
-	if err != nil {
-		log.Print(err)
-	} else {
-		t := make([][]byte, 0)
-		dec := gob.NewDecoder(f)
-		err = dec.Decode(&t)
-		f.Close()
-		for i := 0; i < len(t); i++ {
-			services = append(services, getService(config, bytesToToken(t[i])))
+	return source[:pos]
+}
+
+func rangeHeader(offset, length uint64) string {
+	return fmt.Sprintf("bytes=%d-%d", offset, offset + length - 1)
+}
+
+// copyRange copies the requested range of a ranged GET response to writer,
+// skipping ahead itself when the server ignored the Range header.
+func copyRange(resp *http.Response, offset, length uint64, writer io.Writer) error {
+	if resp.StatusCode != http.StatusPartialContent && offset > 0 {
+		_, err := io.CopyN(ioutil.Discard, resp.Body, int64(offset))
+		if err != nil {
+			return err
 		}
 	}
-	servicesUsed = make([]bool, len(services))
-	fmt.Println("drive load ok")
+	_, err := io.CopyN(writer, resp.Body, int64(length))
+	return err
 }
 
-func AddToken() {
-	f, err := os.Open(TOKEN_FILE)
-	t := make([][]byte, 0)
-	if err != nil {
-		log.Print(err)
-	} else {
-		dec := gob.NewDecoder(f)
-		err = dec.Decode(&t)
-		f.Close()
-	}
-	t = append(t, tokenToBytes(getTokenFromWeb(config)))
-	f, err = os.Create(TOKEN_FILE)
-	if err != nil {
-		log.Fatal(err)
+// Download downloads a block with priority prio if b schedules its
+// transfers.
+func Download(b Backend, src string, writer io.Writer, prio int) error {
+	if p, ok := b.(Prioritizer); ok {
+		return p.DownloadPrio(src, writer, prio)
 	}
-	defer f.Close()
-	enc := gob.NewEncoder(f)
-	err = enc.Encode(t)
-	if err != nil {
-		log.Fatal(err)
-	}
-	fmt.Println("drive addtoken ok")
+	return b.Download(src, writer)
 }
 
-func randstr() string {
-	return fmt.Sprintf("%02x", rand.Intn(256))
+func DownloadRange(b Backend, src string, offset, length uint64, writer io.Writer, prio int) error {
+	if p, ok := b.(Prioritizer); ok {
+		return p.DownloadRangePrio(src, offset, length, writer, prio)
+	}
+	return b.DownloadRange(src, offset, length, writer)
 }
 
-func upload(service *drive.Service, src, sid string) string {
-	s1 := randstr()
-	s2 := randstr()
-	cur := ROOT_FOLDER
-	fmt.Println("upload", src, s1, s2)
-	dirMutex.Lock()
-	if val, ok := dirMap[s1]; !ok {
-		cur = createDirF(service, s1, cur)
-		dirMap[s1] = cur
-	} else {
-		cur = val
-	}
-	if val, ok := dirMap[s1 + "/" + s2]; !ok {
-		cur = createDirF(service, s2, cur)
-		dirMap[s1 + "/" + s2] = cur
-	} else {
-		cur = val
+// ReadRange downloads length bytes at offset of a block.
+func ReadRange(b Backend, src string, offset, length uint64, prio int) ([]byte, error) {
+	buf := bytes.NewBuffer(make([]byte, 0, length))
+	err := DownloadRange(b, src, offset, length, buf, prio)
+	if err != nil {
+		return nil, err
 	}
-	dirMutex.Unlock()
-	fo := fmt.Sprintf("%06x", rand.Intn(1 << 24))
-	fn := fo + "_" + sid
-	id := uploadFileF(service, fn, src, cur)
-	fmt.Println("upload ok", src, s1, s2)
-	return id + "|" + s1 + "/" + s2 + "/" + fo
+	return buf.Bytes(), nil
 }
 
-func download(service *drive.Service, id, dst string) {
-	pos := strings.Index(id, "|")
-	downloadFileF(service, id[:pos], dst)
+// UploadFile uploads src, retrying until it succeeds.
+func UploadFile(b Backend, src, id string) string {
+	for true {
+		res, err := b.Upload(src, id)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			return res
+		}
+		time.Sleep(1 * time.Second)
+	}
+	return ""
 }
 
-func CacheFile(src, dst string, sz uint64) {
-	var sid int = -1
+// UploadReplicas uploads src to n places if b is a Replicator, and once
+// otherwise, retrying until at least one copy is made. The places of the
+// copies in avoid aren't used again.
+func UploadReplicas(b Backend, src, id string, n int, avoid []string) []string {
+	r, ok := b.(Replicator)
+	if !ok || (n <= 1 && len(avoid) == 0) {
+		return []string{UploadFile(b, src, id)}
+	}
 	for true {
-		serviceMutex.Lock()
-		ts := rand.Perm(len(services))
-		for i := 0; i < len(services); i++ {
-			if !servicesUsed[ts[i]] {
-				sid = ts[i]
-				servicesUsed[ts[i]] = true
-				break
+		res, err := r.UploadReplicas(src, id, n, avoid)
+		if err != nil {
+			fmt.Println(err)
+		} else {
+			if len(res) < n {
+				log.Print("only ", len(res), " of ", n, " copies of ", id, " could be uploaded")
 			}
+			return res
 		}
-		serviceMutex.Unlock()
-		if sid != -1 {
-			break
-		}
-		time.Sleep(20 * time.Millisecond)
+		time.Sleep(1 * time.Second)
 	}
-	fmt.Println("CacheFile:", sid, src, dst)
-	if src == "" {
-		fmt.Println("Cache null file")
-		f, _ := os.Create(dst)
-		f.Truncate(int64(sz))
-		return
+	return nil
+}
+
+// Spread is Spreader.Spread, 1 for backends which aren't one.
+func Spread(b Backend) int {
+	if s, ok := b.(Spreader); ok {
+		return s.Spread()
 	}
-	download(services[sid], src, dst)
-	serviceMutex.Lock()
-	servicesUsed[sid] = false
-	serviceMutex.Unlock()
+	return 1
 }
 
-func MoveFile(src, id string) string {
-	var sid int = -1
-	for true {
-		serviceMutex.Lock()
-		ts := rand.Perm(len(services))
-		for i := 0; i < len(services); i++ {
-			if !servicesUsed[ts[i]] {
-				sid = ts[i]
-				servicesUsed[ts[i]] = true
-				break
-			}
-		}
-		serviceMutex.Unlock()
-		if sid != -1 {
-			break
+// UploadSpread is Spreader.UploadSpread, uploading the files one after the
+// other with backends which aren't one.
+func UploadSpread(b Backend, srcs, names []string) []string {
+	if s, ok := b.(Spreader); ok {
+		return s.UploadSpread(srcs, names)
+	}
+	res := make([]string, len(srcs))
+	for i := range srcs {
+		t, err := b.Upload(srcs[i], names[i])
+		if err != nil {
+			fmt.Println(err)
+			continue
 		}
-		time.Sleep(20 * time.Millisecond)
+		res[i] = t
 	}
-	fmt.Println("uploading using", sid)
-	res := upload(services[sid], src, id)
-	serviceMutex.Lock()
-	servicesUsed[sid] = false
-	serviceMutex.Unlock()
-	os.Remove(src)
 	return res
 }
 
-func WaitAll() {
-	for true {
-		done := true
-		serviceMutex.Lock()
-		for i := 0; i < len(services); i++ {
-			if servicesUsed[i] {
-				done = false
-				break
-			}
-		}
-		serviceMutex.Unlock()
-		if done {
-			break
-		}
-		time.Sleep(20 * time.Millisecond)
-	}
+func MoveFile(b Backend, src, id string) string {
+	res := UploadFile(b, src, id)
+	os.Remove(src)
+	return res
 }
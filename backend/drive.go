@@ -0,0 +1,765 @@
+package backend
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+	"google.golang.org/api/drive/v3"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"time"
+	"encoding/gob"
+	"math/rand"
+	"strings"
+	"sync"
+)
+
+const CONFIG_FILE = "drive_credentials"
+const TOKEN_FILE = "drive_tokens"
+const DIRMAP_FILE = "drive_dirmap"
+const ROOT_FOLDER = "your root folder id"
+
+func init() {
+	register("drive", func() Backend { return &Drive{} })
+}
+
+func getConfig() *oauth2.Config {
+	b, err := ioutil.ReadFile(CONFIG_FILE)
+	if err != nil {
+		return nil
+	}
+	config, err := google.ConfigFromJSON(b, drive.DriveFileScope)
+	if err != nil {
+		return nil
+	}
+	return config
+}
+
+func getService(config *oauth2.Config, token *oauth2.Token) *drive.Service {
+	tr := &http.Transport{
+		MaxIdleConns: 200,
+		MaxIdleConnsPerHost: 200,
+	}
+	tclient := &http.Client{Transport: tr}
+	client := config.Client(context.WithValue(context.Background(), oauth2.HTTPClient, tclient), token)
+	service, err := drive.New(client)
+	if err != nil {
+		return nil
+	}
+	return service
+}
+
+func bytesToToken(s []byte) *oauth2.Token {
+	tok := &oauth2.Token{}
+	err := json.Unmarshal(s, tok)
+	if err != nil {
+		return nil
+	}
+	return tok
+}
+
+func tokenToBytes(token *oauth2.Token) []byte {
+	s, err := json.Marshal(token)
+	if err != nil {
+		return nil
+	}
+	return s
+}
+
+func createDir(service *drive.Service, name string, parentId string) (string, error) {
+	d := &drive.File{
+		Name: name,
+		MimeType: "application/vnd.google-apps.folder",
+		Parents: []string{parentId},
+	}
+
+	file, err := service.Files.Create(d).SupportsTeamDrives(true).Do()
+
+	if err != nil {
+		return "", err
+	}
+
+	return file.Id, err
+}
+
+func createFile(service *drive.Service, name string, mimeType string, content io.Reader, parentId string) (string, error) {
+	f := &drive.File{
+		MimeType: mimeType,
+		Name: name,
+		Parents: []string{parentId},
+	}
+
+	fmt.Println("start create######################")
+	file, err := service.Files.Create(f).Media(content).SupportsTeamDrives(true).Do()
+	fmt.Println("end create========================")
+
+	if err != nil {
+		return "", err
+	}
+
+	return file.Id, err
+}
+
+func downloadFile(service *drive.Service, id string, writer io.Writer) error {
+	//fmt.Println(id)
+	req, err := service.Files.Get(id).SupportsTeamDrives(true).Download()
+	if err != nil {
+		return err
+	}
+	defer req.Body.Close()
+	_, err = io.Copy(writer, req.Body)
+	return err
+}
+
+func downloadFileRange(service *drive.Service, id string, offset, length uint64, writer io.Writer) error {
+	call := service.Files.Get(id).SupportsTeamDrives(true)
+	call.Header().Set("Range", rangeHeader(offset, length))
+	req, err := call.Download()
+	if err != nil {
+		return err
+	}
+	defer req.Body.Close()
+	return copyRange(req, offset, length, writer)
+}
+
+func listFiles(service *drive.Service, parentId string) ([]*drive.File, error) {
+	res := make([]*drive.File, 0)
+	token := ""
+	for true {
+		call := service.Files.List().Q("'" + parentId + "' in parents and trashed = false").
+			Fields("nextPageToken", "files(id, name, size, mimeType)").
+			SupportsTeamDrives(true).IncludeTeamDriveItems(true).PageSize(1000)
+		if token != "" {
+			call = call.PageToken(token)
+		}
+		r, err := call.Do()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r.Files...)
+		token = r.NextPageToken
+		if token == "" {
+			break
+		}
+	}
+	return res, nil
+}
+
+func getTokenFromWeb(config *oauth2.Config) *oauth2.Token {
+	authURL := config.AuthCodeURL("state-token", oauth2.AccessTypeOffline)
+	authURL = strings.Replace(authURL, "drive.file", "drive", -1)
+	fmt.Printf("Go to the following link in your browser then type the authorization code: \n%v\n", authURL)
+
+	var authCode string
+	if _, err := fmt.Scan(&authCode); err != nil {
+		log.Fatalf("Unable to read authorization code %v", err)
+	}
+
+	tok, err := config.Exchange(context.TODO(), authCode)
+	if err != nil {
+		log.Fatalf("Unable to retrieve token from web %v", err)
+	}
+	return tok
+}
+
+// Drive stores blocks in a Google Drive folder, spreading transfers over
+// every account in TOKEN_FILE. Sources look like "fileid|s1/s2/fo".
+type Drive struct {
+	config *oauth2.Config
+	services []*drive.Service
+	dirMap map[string]string
+	sched *Scheduler
+	accounts []account
+	serviceMutex, dirMutex, accountsMutex sync.Mutex
+}
+
+func (d *Drive) Save() {
+	f, err := os.Create(DIRMAP_FILE)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	enc := gob.NewEncoder(f)
+	d.dirMutex.Lock()
+	err = enc.Encode(d.dirMap)
+	d.dirMutex.Unlock()
+	if err != nil {
+		log.Fatal(err)
+	}
+	d.saveAccounts()
+	fmt.Println("drive save ok")
+}
+
+func (d *Drive) Load() {
+	rand.Seed(time.Now().UnixNano())
+	d.config = getConfig()
+	if d.config == nil {
+		log.Fatal("read config failed")
+	}
+	f, err := os.Open(DIRMAP_FILE)
+	if err != nil {
+		log.Print(err)
+		d.dirMap = make(map[string]string)
+	} else {
+		dec := gob.NewDecoder(f)
+		err = dec.Decode(&d.dirMap)
+		f.Close()
+	}
+	f, err = os.Open(TOKEN_FILE)
+	d.services = make([]*drive.Service, 0)
+	if err != nil {
+		log.Print(err)
+	} else {
+		t := make([][]byte, 0)
+		dec := gob.NewDecoder(f)
+		err = dec.Decode(&t)
+		f.Close()
+		for i := 0; i < len(t); i++ {
+			d.services = append(d.services, getService(d.config, bytesToToken(t[i])))
+		}
+	}
+	d.sched = newScheduler(len(d.services))
+	d.loadAccounts()
+	fmt.Println("drive load ok")
+}
+
+func (d *Drive) AddToken() {
+	f, err := os.Open(TOKEN_FILE)
+	t := make([][]byte, 0)
+	if err != nil {
+		log.Print(err)
+	} else {
+		dec := gob.NewDecoder(f)
+		err = dec.Decode(&t)
+		f.Close()
+	}
+	t = append(t, tokenToBytes(getTokenFromWeb(d.config)))
+	f, err = os.Create(TOKEN_FILE)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer f.Close()
+	enc := gob.NewEncoder(f)
+	err = enc.Encode(t)
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("drive addtoken ok")
+}
+
+// acquire waits for a slot of an account which can be used, for an upload
+// of size bytes if prio is PRIO_UPLOAD.
+func (d *Drive) acquire(prio int, size uint64) (int, error) {
+	return d.sched.Acquire(prio, -1, func(sid int) time.Time {
+		return d.readyAt(sid, prio == PRIO_UPLOAD, size)
+	})
+}
+
+// acquireId waits for an upload slot of account sid.
+func (d *Drive) acquireId(sid int) error {
+	_, err := d.sched.Acquire(PRIO_UPLOAD, sid, nil)
+	return err
+}
+
+func (d *Drive) release(sid, prio int) {
+	d.sched.Release(sid, prio)
+}
+
+// getDir returns the folder path, creating it with account sid. The map is
+// only locked around its use, so that other uploads don't wait for the call.
+func (d *Drive) getDir(sid int, path, name, parentId string) (string, error) {
+	d.dirMutex.Lock()
+	val, ok := d.dirMap[path]
+	d.dirMutex.Unlock()
+	if ok {
+		return val, nil
+	}
+	res, err := createDir(d.services[sid], name, parentId)
+	if d.check(sid, true, err) != nil {
+		return "", err
+	}
+	d.dirMutex.Lock()
+	defer d.dirMutex.Unlock()
+	// another upload may have made it meanwhile, ours stays empty
+	if val, ok := d.dirMap[path]; ok {
+		return val, nil
+	}
+	d.dirMap[path] = res
+	return res, nil
+}
+
+func fileSize(src string) uint64 {
+	st, err := os.Stat(src)
+	if err != nil {
+		return 0
+	}
+	return uint64(st.Size())
+}
+
+func (d *Drive) Upload(src, name string) (string, error) {
+	sid, err := d.acquire(PRIO_UPLOAD, fileSize(src))
+	if err != nil {
+		return "", err
+	}
+	defer d.release(sid, PRIO_UPLOAD)
+	return d.upload(sid, src, name)
+}
+
+// email returns the address of account sid, asking it the first time.
+func (d *Drive) email(sid int) string {
+	d.serviceMutex.Lock()
+	res := d.accounts[sid].Email
+	d.serviceMutex.Unlock()
+	if res != "" {
+		return res
+	}
+	r, err := d.services[sid].About.Get().Fields("user").Do()
+	if d.check(sid, false, err) != nil || r.User == nil {
+		return ""
+	}
+	d.serviceMutex.Lock()
+	d.accounts[sid].Email = r.User.EmailAddress
+	d.serviceMutex.Unlock()
+	return r.User.EmailAddress
+}
+
+// owner returns the account which owns source, -1 if it isn't one of ours
+// or can't be told (files of shared drives have no owner).
+func (d *Drive) owner(source string) int {
+	sid, err := d.acquire(PRIO_READ, 0)
+	if err != nil {
+		return -1
+	}
+	f, err := d.services[sid].Files.Get(sourceId(source)).Fields("owners(emailAddress)").SupportsTeamDrives(true).Do()
+	err = d.check(sid, false, err)
+	d.release(sid, PRIO_READ)
+	if err != nil || len(f.Owners) == 0 {
+		return -1
+	}
+	for i := range d.services {
+		if d.email(i) == f.Owners[0].EmailAddress {
+			return i
+		}
+	}
+	return -1
+}
+
+// UploadReplicas uploads src with up to n different accounts, trying the
+// next one when an account fails (suspended, over quota...), and skipping
+// those which can't be used now and those owning the copies in avoid.
+func (d *Drive) UploadReplicas(src, name string, n int, avoid []string) ([]string, error) {
+	res := make([]string, 0)
+	var err error
+	size := fileSize(src)
+	skip := make(map[int]bool)
+	for _, s := range avoid {
+		if sid := d.owner(s); sid >= 0 {
+			skip[sid] = true
+		} else {
+			log.Print("drive: account of ", s, " unknown, a copy may go to it again")
+		}
+	}
+	for _, sid := range rand.Perm(len(d.services)) {
+		if len(res) >= n {
+			break
+		}
+		if skip[sid] || !d.ready(sid, true, size) {
+			continue
+		}
+		if err = d.acquireId(sid); err != nil {
+			continue
+		}
+		var t string
+		t, err = d.upload(sid, src, name)
+		d.release(sid, PRIO_UPLOAD)
+		if err != nil {
+			fmt.Println("upload using", sid, "failed:", err)
+			continue
+		}
+		res = append(res, t)
+	}
+	if len(res) == 0 {
+		if err == nil {
+			err = errors.New("drive: no accounts")
+		}
+		return nil, err
+	}
+	return res, nil
+}
+
+// UploadSpread uploads the files at once, each with another account while
+// there are enough, an account which fails being replaced by the next one.
+func (d *Drive) UploadSpread(srcs, names []string) []string {
+	res := make([]string, len(srcs))
+	// the accounts which can upload now come first, so that they are the
+	// ones shared out
+	perm := make([]int, 0, len(d.services))
+	later := make([]int, 0)
+	for _, sid := range rand.Perm(len(d.services)) {
+		if d.ready(sid, true, 0) {
+			perm = append(perm, sid)
+		} else {
+			later = append(later, sid)
+		}
+	}
+	if len(perm) < len(srcs) {
+		log.Print("drive: only ", len(perm), " accounts can upload now for ", len(srcs), " files, some of them share one")
+	}
+	perm = append(perm, later...)
+	var wg sync.WaitGroup
+	for i := range srcs {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			size := fileSize(srcs[i])
+			for t := 0; t < len(perm); t++ {
+				sid := perm[(i + t) % len(perm)]
+				if !d.ready(sid, true, size) {
+					continue
+				}
+				if d.acquireId(sid) != nil {
+					continue
+				}
+				s, err := d.upload(sid, srcs[i], names[i])
+				d.release(sid, PRIO_UPLOAD)
+				if err == nil {
+					res[i] = s
+					return
+				}
+				fmt.Println("upload using", sid, "failed:", err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	return res
+}
+
+func (d *Drive) Spread() int {
+	return len(d.services)
+}
+
+func (d *Drive) upload(sid int, src, name string) (string, error) {
+	fmt.Println("uploading using", sid)
+	service := d.services[sid]
+	s1 := randstr()
+	s2 := randstr()
+	fmt.Println("upload", src, s1, s2)
+	cur, err := d.getDir(sid, s1, s1, ROOT_FOLDER)
+	if err != nil {
+		return "", err
+	}
+	cur, err = d.getDir(sid, s1 + "/" + s2, s2, cur)
+	if err != nil {
+		return "", err
+	}
+	fo := fmt.Sprintf("%06x", rand.Intn(1 << 24))
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	id, err := createFile(service, fo + "_" + name, "application/octet-stream", f, cur)
+	if d.check(sid, true, err) != nil {
+		return "", err
+	}
+	if st, err := f.Stat(); err == nil {
+		d.uploaded(sid, uint64(st.Size()))
+	}
+	fmt.Println("upload ok", src, s1, s2)
+	return id + "|" + s1 + "/" + s2 + "/" + fo, nil
+}
+
+func (d *Drive) Download(source string, writer io.Writer) error {
+	return d.DownloadPrio(source, writer, PRIO_READ)
+}
+
+func (d *Drive) DownloadRange(source string, offset, length uint64, writer io.Writer) error {
+	return d.DownloadRangePrio(source, offset, length, writer, PRIO_READ)
+}
+
+func (d *Drive) DownloadPrio(source string, writer io.Writer, prio int) error {
+	sid, err := d.acquire(prio, 0)
+	if err != nil {
+		return err
+	}
+	defer d.release(sid, prio)
+	fmt.Println("downloading using", sid)
+	return d.check(sid, false, downloadFile(d.services[sid], sourceId(source), writer))
+}
+
+func (d *Drive) DownloadRangePrio(source string, offset, length uint64, writer io.Writer, prio int) error {
+	sid, err := d.acquire(prio, 0)
+	if err != nil {
+		return err
+	}
+	defer d.release(sid, prio)
+	return d.check(sid, false, downloadFileRange(d.services[sid], sourceId(source), offset, length, writer))
+}
+
+func (d *Drive) Delete(source string) error {
+	sid, err := d.acquire(PRIO_READ, 0)
+	if err != nil {
+		return err
+	}
+	defer d.release(sid, PRIO_READ)
+	err = d.check(sid, false, d.services[sid].Files.Delete(sourceId(source)).SupportsTeamDrives(true).Do())
+	if err != nil {
+		if code, _ := errorReason(err); code == http.StatusNotFound {
+			return ErrNotFound
+		}
+	}
+	return err
+}
+
+func (d *Drive) Stat(source string) (Object, error) {
+	sid, err := d.acquire(PRIO_READ, 0)
+	if err != nil {
+		return Object{}, err
+	}
+	defer d.release(sid, PRIO_READ)
+	f, err := d.services[sid].Files.Get(sourceId(source)).Fields("id", "name", "size").SupportsTeamDrives(true).Do()
+	if d.check(sid, false, err) != nil {
+		return Object{}, err
+	}
+	return Object{source, f.Name, uint64(f.Size)}, nil
+}
+
+func (d *Drive) Quota() (uint64, uint64, error) {
+	var total, used uint64
+	unlimited := false
+	for i := 0; i < len(d.services); i++ {
+		a, err := d.services[i].About.Get().Fields("storageQuota").Do()
+		if d.check(i, false, err) != nil {
+			return 0, 0, err
+		}
+		d.setQuota(i, uint64(a.StorageQuota.Limit), uint64(a.StorageQuota.Usage))
+		// no limit for unlimited accounts
+		if a.StorageQuota.Limit == 0 {
+			unlimited = true
+		}
+		total += uint64(a.StorageQuota.Limit)
+		used += uint64(a.StorageQuota.Usage)
+	}
+	if unlimited {
+		total = 0
+	}
+	return total, used, nil
+}
+
+func (d *Drive) List() ([]Object, error) {
+	sid, err := d.acquire(PRIO_READ, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer d.release(sid, PRIO_READ)
+	service := d.services[sid]
+	res := make([]Object, 0)
+	l1, err := listFiles(service, ROOT_FOLDER)
+	if d.check(sid, false, err) != nil {
+		return nil, err
+	}
+	for _, a := range l1 {
+		if a.MimeType != "application/vnd.google-apps.folder" {
+			continue
+		}
+		l2, err := listFiles(service, a.Id)
+		if d.check(sid, false, err) != nil {
+			return nil, err
+		}
+		for _, b := range l2 {
+			if b.MimeType != "application/vnd.google-apps.folder" {
+				continue
+			}
+			l3, err := listFiles(service, b.Id)
+			if d.check(sid, false, err) != nil {
+				return nil, err
+			}
+			for _, c := range l3 {
+				pos := strings.Index(c.Name, "_")
+				if pos == -1 {
+					continue
+				}
+				res = append(res, Object{c.Id + "|" + a.Name + "/" + b.Name + "/" + c.Name[:pos], c.Name, uint64(c.Size)})
+			}
+		}
+	}
+	return res, nil
+}
+
+func (d *Drive) Wait() {
+	d.sched.Wait()
+}
+
+// metaDir returns the folder META_DIR, looking for it in ROOT_FOLDER before
+// creating it with account sid, so that a new install finds the copies of an
+// old one. The map stays locked so that there is only one.
+func (d *Drive) metaDir(sid int) (string, error) {
+	d.dirMutex.Lock()
+	defer d.dirMutex.Unlock()
+	name := strings.TrimSuffix(META_DIR, "/")
+	if val, ok := d.dirMap[name]; ok {
+		return val, nil
+	}
+	service := d.services[sid]
+	t, err := listFiles(service, ROOT_FOLDER)
+	if d.check(sid, false, err) != nil {
+		return "", err
+	}
+	res := ""
+	for _, a := range t {
+		if a.Name == name && a.MimeType == "application/vnd.google-apps.folder" {
+			res = a.Id
+		}
+	}
+	if res == "" {
+		res, err = createDir(service, name, ROOT_FOLDER)
+		if d.check(sid, true, err) != nil {
+			return "", err
+		}
+	}
+	d.dirMap[name] = res
+	return res, nil
+}
+
+// metaFiles returns the ids of the files in META_DIR by name.
+func (d *Drive) metaFiles(sid int) (map[string]string, error) {
+	dir, err := d.metaDir(sid)
+	if err != nil {
+		return nil, err
+	}
+	t, err := listFiles(d.services[sid], dir)
+	if d.check(sid, false, err) != nil {
+		return nil, err
+	}
+	res := make(map[string]string)
+	for _, a := range t {
+		res[a.Name] = a.Id
+	}
+	return res, nil
+}
+
+func (d *Drive) PutMeta(name string, data []byte) error {
+	sid, err := d.acquire(PRIO_UPLOAD, uint64(len(data)))
+	if err != nil {
+		return err
+	}
+	defer d.release(sid, PRIO_UPLOAD)
+	dir, err := d.metaDir(sid)
+	if err != nil {
+		return err
+	}
+	_, err = createFile(d.services[sid], name, "application/octet-stream", bytes.NewReader(data), dir)
+	return d.check(sid, true, err)
+}
+
+func (d *Drive) GetMeta(name string) ([]byte, error) {
+	sid, err := d.acquire(PRIO_READ, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer d.release(sid, PRIO_READ)
+	t, err := d.metaFiles(sid)
+	if err != nil {
+		return nil, err
+	}
+	id, ok := t[name]
+	if !ok {
+		return nil, fmt.Errorf("drive: no %s%s", META_DIR, name)
+	}
+	buf := new(bytes.Buffer)
+	err = downloadFile(d.services[sid], id, buf)
+	if d.check(sid, false, err) != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func (d *Drive) ListMeta() ([]string, error) {
+	sid, err := d.acquire(PRIO_READ, 0)
+	if err != nil {
+		return nil, err
+	}
+	defer d.release(sid, PRIO_READ)
+	t, err := d.metaFiles(sid)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	for name := range t {
+		res = append(res, name)
+	}
+	return res, nil
+}
+
+func (d *Drive) DeleteMeta(name string) error {
+	sid, err := d.acquire(PRIO_READ, 0)
+	if err != nil {
+		return err
+	}
+	defer d.release(sid, PRIO_READ)
+	t, err := d.metaFiles(sid)
+	if err != nil {
+		return err
+	}
+	id, ok := t[name]
+	if !ok {
+		return nil
+	}
+	err = d.services[sid].Files.Delete(id).SupportsTeamDrives(true).Do()
+	return d.check(sid, false, err)
+}
+
+// RebuildDirs replaces the dir map with the s1 and s1/s2 folders found in
+// ROOT_FOLDER, and META_DIR.
+func (d *Drive) RebuildDirs() error {
+	sid, err := d.acquire(PRIO_READ, 0)
+	if err != nil {
+		return err
+	}
+	defer d.release(sid, PRIO_READ)
+	service := d.services[sid]
+	res := make(map[string]string)
+	l1, err := listFiles(service, ROOT_FOLDER)
+	if d.check(sid, false, err) != nil {
+		return err
+	}
+	for _, a := range l1 {
+		if a.MimeType != "application/vnd.google-apps.folder" {
+			continue
+		}
+		if _, ok := res[a.Name]; ok {
+			log.Print("drive: more than one folder ", a.Name)
+			continue
+		}
+		res[a.Name] = a.Id
+		if a.Name + "/" == META_DIR {
+			continue
+		}
+		l2, err := listFiles(service, a.Id)
+		if d.check(sid, false, err) != nil {
+			return err
+		}
+		for _, b := range l2 {
+			if b.MimeType != "application/vnd.google-apps.folder" {
+				continue
+			}
+			if _, ok := res[a.Name + "/" + b.Name]; ok {
+				log.Print("drive: more than one folder ", a.Name + "/" + b.Name)
+				continue
+			}
+			res[a.Name + "/" + b.Name] = b.Id
+		}
+	}
+	d.dirMutex.Lock()
+	d.dirMap = res
+	d.dirMutex.Unlock()
+	fmt.Println("drive:", len(res), "folders")
+	return nil
+}
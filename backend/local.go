@@ -0,0 +1,200 @@
+package backend
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+)
+
+const LOCAL_PATH = "blocks/"
+
+func init() {
+	register("local", func() Backend { return &Local{Root: LOCAL_PATH} })
+}
+
+// Local stores blocks in a directory, which may be a NFS or other network
+// mount. The layout mirrors the one used on Drive, and sources look like
+// "s1/s2/fo_name|s1/s2/fo".
+type Local struct {
+	Root string
+	running
+}
+
+func (l *Local) Load() {
+	err := os.MkdirAll(l.Root, 0755)
+	if err != nil {
+		fmt.Println(err)
+	}
+	fmt.Println("local load ok")
+}
+
+func (l *Local) Save() {
+}
+
+func (l *Local) path(source string) string {
+	return l.Root + sourceId(source)
+}
+
+func copyFile(src, dst string) error {
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(w, r)
+	if err == nil {
+		err = w.Sync()
+	}
+	if err2 := w.Close(); err == nil {
+		err = err2
+	}
+	return err
+}
+
+func (l *Local) Upload(src, name string) (string, error) {
+	l.begin()
+	defer l.end()
+	s1 := randstr()
+	s2 := randstr()
+	fo := fmt.Sprintf("%06x", rand.Intn(1 << 24))
+	dir := s1 + "/" + s2 + "/"
+	err := os.MkdirAll(l.Root + dir, 0755)
+	if err != nil {
+		return "", err
+	}
+	id := dir + fo + "_" + name
+	tmp := l.Root + id + ".part"
+	err = copyFile(src, tmp)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	err = os.Rename(tmp, l.Root + id)
+	if err != nil {
+		os.Remove(tmp)
+		return "", err
+	}
+	fmt.Println("upload ok", src, s1, s2)
+	return id + "|" + dir + fo, nil
+}
+
+func (l *Local) Download(source string, writer io.Writer) error {
+	l.begin()
+	defer l.end()
+	f, err := os.Open(l.path(source))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.Copy(writer, f)
+	return err
+}
+
+func (l *Local) DownloadRange(source string, offset, length uint64, writer io.Writer) error {
+	l.begin()
+	defer l.end()
+	f, err := os.Open(l.path(source))
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	_, err = io.CopyN(writer, io.NewSectionReader(f, int64(offset), int64(length)), int64(length))
+	return err
+}
+
+func (l *Local) Delete(source string) error {
+	err := os.Remove(l.path(source))
+	if os.IsNotExist(err) {
+		return ErrNotFound
+	}
+	return err
+}
+
+func (l *Local) Stat(source string) (Object, error) {
+	s, err := os.Stat(l.path(source))
+	if err != nil {
+		return Object{}, err
+	}
+	return Object{source, s.Name(), uint64(s.Size())}, nil
+}
+
+func (l *Local) List() ([]Object, error) {
+	res := make([]Object, 0)
+	l1, err := ioutil.ReadDir(l.Root)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range l1 {
+		if !a.IsDir() {
+			continue
+		}
+		l2, err := ioutil.ReadDir(l.Root + a.Name())
+		if err != nil {
+			return nil, err
+		}
+		for _, b := range l2 {
+			if !b.IsDir() {
+				continue
+			}
+			dir := a.Name() + "/" + b.Name() + "/"
+			l3, err := ioutil.ReadDir(l.Root + dir)
+			if err != nil {
+				return nil, err
+			}
+			for _, c := range l3 {
+				pos := strings.Index(c.Name(), "_")
+				if c.IsDir() || pos == -1 || strings.HasSuffix(c.Name(), ".part") {
+					continue
+				}
+				res = append(res, Object{dir + c.Name() + "|" + dir + c.Name()[:pos], c.Name(), uint64(c.Size())})
+			}
+		}
+	}
+	return res, nil
+}
+
+func (l *Local) PutMeta(name string, data []byte) error {
+	err := os.MkdirAll(l.Root + META_DIR, 0755)
+	if err != nil {
+		return err
+	}
+	tmp := l.Root + META_DIR + name + ".part"
+	err = ioutil.WriteFile(tmp, data, 0644)
+	if err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	return os.Rename(tmp, l.Root + META_DIR + name)
+}
+
+func (l *Local) GetMeta(name string) ([]byte, error) {
+	return ioutil.ReadFile(l.Root + META_DIR + name)
+}
+
+func (l *Local) ListMeta() ([]string, error) {
+	t, err := ioutil.ReadDir(l.Root + META_DIR)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	for _, a := range t {
+		if !a.IsDir() && !strings.HasSuffix(a.Name(), ".part") {
+			res = append(res, a.Name())
+		}
+	}
+	return res, nil
+}
+
+func (l *Local) DeleteMeta(name string) error {
+	return os.Remove(l.Root + META_DIR + name)
+}
@@ -0,0 +1,20 @@
+//go:build linux
+// +build linux
+
+package backend
+
+import (
+	"syscall"
+)
+
+// Quota tells the size of the filesystem holding the blocks.
+func (l *Local) Quota() (uint64, uint64, error) {
+	var st syscall.Statfs_t
+	err := syscall.Statfs(l.Root, &st)
+	if err != nil {
+		return 0, 0, err
+	}
+	used := (st.Blocks - st.Bfree) * uint64(st.Bsize)
+	// blocks reserved for root are left out, as df does
+	return used + st.Bavail * uint64(st.Bsize), used, nil
+}
@@ -0,0 +1,386 @@
+package backend
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"math/rand"
+	"strconv"
+	"strings"
+)
+
+// Multi puts blocks on several backends, for instance "-backend drive,local",
+// copies of a block going to different ones. Sources on backend k > 0 are
+// prefixed with "k:", and those of the first one are left as they are, so
+// that it can be used alone again.
+type Multi struct {
+	parts []Backend
+}
+
+func newMulti(names []string) Backend {
+	m := &Multi{}
+	for _, name := range names {
+		m.parts = append(m.parts, New(name))
+	}
+	return m
+}
+
+func (m *Multi) wrap(k int, source string) string {
+	if k == 0 {
+		return source
+	}
+	return strconv.Itoa(k) + ":" + source
+}
+
+// index returns the number of the backend of source and the source it knows.
+func (m *Multi) index(source string) (int, string, error) {
+	pos := strings.Index(source, ":")
+	if pos == -1 {
+		return 0, source, nil
+	}
+	k, err := strconv.Atoi(source[:pos])
+	if err != nil || k <= 0 || k >= len(m.parts) {
+		return 0, "", fmt.Errorf("multi: no backend for %s", source)
+	}
+	return k, source[pos + 1:], nil
+}
+
+// part returns the backend of source and the source it knows.
+func (m *Multi) part(source string) (Backend, string, error) {
+	k, s, err := m.index(source)
+	if err != nil {
+		return nil, "", err
+	}
+	return m.parts[k], s, nil
+}
+
+func (m *Multi) Load() {
+	for _, b := range m.parts {
+		b.Load()
+	}
+}
+
+func (m *Multi) Save() {
+	for _, b := range m.parts {
+		b.Save()
+	}
+}
+
+func (m *Multi) Upload(src, name string) (string, error) {
+	k := rand.Intn(len(m.parts))
+	res, err := m.parts[k].Upload(src, name)
+	if err != nil {
+		return "", err
+	}
+	return m.wrap(k, res), nil
+}
+
+// UploadReplicas shares the n copies between the backends, as evenly as it
+// can, leaving those it can't make out. A backend which isn't a Replicator
+// and holds one of avoid takes none.
+func (m *Multi) UploadReplicas(src, name string, n int, avoid []string) ([]string, error) {
+	res := make([]string, 0)
+	var err error
+	held := make([][]string, len(m.parts))
+	for _, s := range avoid {
+		if k, t, err := m.index(s); err == nil {
+			held[k] = append(held[k], t)
+		}
+	}
+	parts := make([]int, 0, len(m.parts))
+	for _, k := range rand.Perm(len(m.parts)) {
+		if _, ok := m.parts[k].(Replicator); ok || len(held[k]) == 0 {
+			parts = append(parts, k)
+		}
+	}
+	for i, k := range parts {
+		c := n / len(parts)
+		if i < n % len(parts) {
+			c++
+		}
+		if c == 0 {
+			continue
+		}
+		var t []string
+		if r, ok := m.parts[k].(Replicator); ok && (c > 1 || len(held[k]) > 0) {
+			t, err = r.UploadReplicas(src, name, c, held[k])
+		} else {
+			var s string
+			s, err = m.parts[k].Upload(src, name)
+			t = []string{s}
+		}
+		if err != nil {
+			fmt.Println("upload to backend", k, "failed:", err)
+			continue
+		}
+		for _, s := range t {
+			res = append(res, m.wrap(k, s))
+		}
+	}
+	if len(res) == 0 {
+		return nil, err
+	}
+	return res, nil
+}
+
+// UploadSpread deals the files out to the backends in turn, a backend with
+// several accounts taking one for each of them before any account takes two.
+func (m *Multi) UploadSpread(srcs, names []string) []string {
+	res := make([]string, len(srcs))
+	perm := rand.Perm(len(m.parts))
+	spread := make([]int, len(m.parts))
+	for k := range m.parts {
+		spread[k] = Spread(m.parts[k])
+	}
+	if m.Spread() < len(srcs) {
+		log.Print("multi: only ", m.Spread(), " accounts or backends for ", len(srcs), " files, some of them share one")
+	}
+	// part[i] is the backend of file i
+	part := make([]int, 0, len(srcs))
+	for r := 0; len(part) < len(srcs); r++ {
+		n := len(part)
+		for _, k := range perm {
+			if r < spread[k] && len(part) < len(srcs) {
+				part = append(part, k)
+			}
+		}
+		if len(part) == n {
+			for _, k := range perm {
+				if len(part) < len(srcs) {
+					part = append(part, k)
+				}
+			}
+		}
+	}
+	for k := range m.parts {
+		ids := make([]int, 0)
+		for i := range srcs {
+			if part[i] == k {
+				ids = append(ids, i)
+			}
+		}
+		if len(ids) == 0 {
+			continue
+		}
+		a := make([]string, len(ids))
+		b := make([]string, len(ids))
+		for j, i := range ids {
+			a[j] = srcs[i]
+			b[j] = names[i]
+		}
+		for j, s := range UploadSpread(m.parts[k], a, b) {
+			if s != "" {
+				res[ids[j]] = m.wrap(k, s)
+			}
+		}
+	}
+	return res
+}
+
+func (m *Multi) Spread() int {
+	n := 0
+	for _, b := range m.parts {
+		n += Spread(b)
+	}
+	return n
+}
+
+func (m *Multi) Download(source string, writer io.Writer) error {
+	b, s, err := m.part(source)
+	if err != nil {
+		return err
+	}
+	return b.Download(s, writer)
+}
+
+func (m *Multi) DownloadRange(source string, offset, length uint64, writer io.Writer) error {
+	b, s, err := m.part(source)
+	if err != nil {
+		return err
+	}
+	return b.DownloadRange(s, offset, length, writer)
+}
+
+func (m *Multi) DownloadPrio(source string, writer io.Writer, prio int) error {
+	b, s, err := m.part(source)
+	if err != nil {
+		return err
+	}
+	return Download(b, s, writer, prio)
+}
+
+func (m *Multi) DownloadRangePrio(source string, offset, length uint64, writer io.Writer, prio int) error {
+	b, s, err := m.part(source)
+	if err != nil {
+		return err
+	}
+	return DownloadRange(b, s, offset, length, writer, prio)
+}
+
+func (m *Multi) Delete(source string) error {
+	b, s, err := m.part(source)
+	if err != nil {
+		return err
+	}
+	return b.Delete(s)
+}
+
+func (m *Multi) Stat(source string) (Object, error) {
+	b, s, err := m.part(source)
+	if err != nil {
+		return Object{}, err
+	}
+	res, err := b.Stat(s)
+	res.Source = source
+	return res, err
+}
+
+func (m *Multi) List() ([]Object, error) {
+	res := make([]Object, 0)
+	for k, b := range m.parts {
+		t, err := b.List()
+		if err != nil {
+			return nil, err
+		}
+		for _, o := range t {
+			o.Source = m.wrap(k, o.Source)
+			res = append(res, o)
+		}
+	}
+	return res, nil
+}
+
+func (m *Multi) Wait() {
+	for _, b := range m.parts {
+		b.Wait()
+	}
+}
+
+// Quota adds up the backends which can tell.
+func (m *Multi) Quota() (uint64, uint64, error) {
+	var total, used uint64
+	unlimited := false
+	known := false
+	for _, b := range m.parts {
+		q, ok := b.(Quota)
+		if !ok {
+			continue
+		}
+		t, u, err := q.Quota()
+		if err != nil {
+			return 0, 0, err
+		}
+		if t == 0 {
+			unlimited = true
+		}
+		total += t
+		used += u
+		known = true
+	}
+	if !known {
+		return 0, 0, errors.New("multi: no backend tells its quota")
+	}
+	if unlimited {
+		total = 0
+	}
+	return total, used, nil
+}
+
+func (m *Multi) AccountStatus() []string {
+	res := make([]string, 0)
+	for k, b := range m.parts {
+		if a, ok := b.(Accounts); ok {
+			for _, s := range a.AccountStatus() {
+				res = append(res, fmt.Sprintf("backend %d, account %s", k, s))
+			}
+		}
+	}
+	return res
+}
+
+func (m *Multi) RebuildDirs() error {
+	for _, b := range m.parts {
+		if dc, ok := b.(DirCache); ok {
+			err := dc.RebuildDirs()
+			if err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+func (m *Multi) metaStores() []MetaStore {
+	res := make([]MetaStore, 0)
+	for _, b := range m.parts {
+		if ms, ok := b.(MetaStore); ok {
+			res = append(res, ms)
+		}
+	}
+	return res
+}
+
+var errMultiNoMeta = errors.New("multi: no backend can keep copies of fs_data")
+
+// PutMeta puts the copy on every backend which can keep it.
+func (m *Multi) PutMeta(name string, data []byte) error {
+	t := m.metaStores()
+	if len(t) == 0 {
+		return errMultiNoMeta
+	}
+	for _, ms := range t {
+		err := ms.PutMeta(name, data)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (m *Multi) GetMeta(name string) ([]byte, error) {
+	err := errMultiNoMeta
+	for _, ms := range m.metaStores() {
+		var res []byte
+		res, err = ms.GetMeta(name)
+		if err == nil {
+			return res, nil
+		}
+	}
+	return nil, err
+}
+
+func (m *Multi) ListMeta() ([]string, error) {
+	seen := make(map[string]bool)
+	res := make([]string, 0)
+	for _, ms := range m.metaStores() {
+		t, err := ms.ListMeta()
+		if err != nil {
+			return nil, err
+		}
+		for _, name := range t {
+			if !seen[name] {
+				seen[name] = true
+				res = append(res, name)
+			}
+		}
+	}
+	return res, nil
+}
+
+// DeleteMeta deletes the copy wherever it is, succeeding if any had it.
+func (m *Multi) DeleteMeta(name string) error {
+	err := errMultiNoMeta
+	done := false
+	for _, ms := range m.metaStores() {
+		if e := ms.DeleteMeta(name); e == nil {
+			done = true
+		} else {
+			err = e
+		}
+	}
+	if done {
+		return nil
+	}
+	return err
+}
@@ -0,0 +1,372 @@
+package backend
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+const S3_CONFIG_FILE = "s3_config"
+
+func init() {
+	register("s3", func() Backend { return &S3{} })
+}
+
+// S3 stores blocks in a bucket of any S3 compatible service (MinIO, Ceph
+// RGW, Backblaze B2, Wasabi...), using path style requests signed with
+// AWS signature v4. Sources look like "s1/s2/fo_name|s1/s2/fo", the part
+// before "|" being the object key below Prefix.
+type S3 struct {
+	Endpoint string `json:"endpoint"`
+	Region string `json:"region"`
+	Bucket string `json:"bucket"`
+	AccessKey string `json:"access_key"`
+	SecretKey string `json:"secret_key"`
+	Prefix string `json:"prefix"`
+	client *http.Client
+	running
+}
+
+func (b *S3) Load() {
+	t, err := ioutil.ReadFile(S3_CONFIG_FILE)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = json.Unmarshal(t, b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b.Endpoint = strings.TrimRight(b.Endpoint, "/")
+	if b.Region == "" {
+		b.Region = "us-east-1"
+	}
+	b.client = &http.Client{Transport: &http.Transport{
+		MaxIdleConns: 200,
+		MaxIdleConnsPerHost: 200,
+	}}
+	fmt.Println("s3 load ok")
+}
+
+func (b *S3) Save() {
+}
+
+func awsEscape(s string, keepSlash bool) string {
+	res := make([]byte, 0, len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if (c >= 'A' && c <= 'Z') || (c >= 'a' && c <= 'z') || (c >= '0' && c <= '9') ||
+			c == '-' || c == '_' || c == '.' || c == '~' || (keepSlash && c == '/') {
+			res = append(res, c)
+		} else {
+			res = append(res, fmt.Sprintf("%%%02X", c)...)
+		}
+	}
+	return string(res)
+}
+
+func canonicalQuery(query url.Values) string {
+	keys := make([]string, 0, len(query))
+	for k := range query {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	qs := make([]string, 0, len(keys))
+	for _, k := range keys {
+		vs := query[k]
+		sort.Strings(vs)
+		for _, v := range vs {
+			qs = append(qs, awsEscape(k, false) + "=" + awsEscape(v, false))
+		}
+	}
+	return strings.Join(qs, "&")
+}
+
+func hmacSHA256(key []byte, s string) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write([]byte(s))
+	return h.Sum(nil)
+}
+
+func signingKey(secret, date, region, service string) []byte {
+	key := hmacSHA256([]byte("AWS4" + secret), date)
+	key = hmacSHA256(key, region)
+	key = hmacSHA256(key, service)
+	return hmacSHA256(key, "aws4_request")
+}
+
+// sign adds the AWS signature v4 headers to req. The payload is not hashed
+// unless x-amz-content-sha256 is set already, uploads of whole blocks would
+// have to be read twice otherwise.
+func (b *S3) sign(req *http.Request) {
+	b.signAt(req, time.Now())
+}
+
+func (b *S3) signAt(req *http.Request, now time.Time) {
+	now = now.UTC()
+	amzDate := now.Format("20060102T150405Z")
+	date := now.Format("20060102")
+	req.Header.Set("x-amz-date", amzDate)
+	payload := req.Header.Get("x-amz-content-sha256")
+	if payload == "" {
+		payload = "UNSIGNED-PAYLOAD"
+		req.Header.Set("x-amz-content-sha256", payload)
+	}
+
+	headers := []string{"host", "x-amz-content-sha256", "x-amz-date"}
+	if req.Header.Get("Range") != "" {
+		headers = append(headers, "range")
+	}
+	sort.Strings(headers)
+	ch := ""
+	for _, h := range headers {
+		v := req.Header.Get(h)
+		if h == "host" {
+			v = req.URL.Host
+		}
+		ch += h + ":" + strings.TrimSpace(v) + "\n"
+	}
+	signed := strings.Join(headers, ";")
+
+	canonical := strings.Join([]string{
+		req.Method,
+		req.URL.EscapedPath(),
+		req.URL.RawQuery,
+		ch,
+		signed,
+		payload,
+	}, "\n")
+	scope := date + "/" + b.Region + "/s3/aws4_request"
+	hc := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + amzDate + "\n" + scope + "\n" + hex.EncodeToString(hc[:])
+
+	sig := hex.EncodeToString(hmacSHA256(signingKey(b.SecretKey, date, b.Region, "s3"), toSign))
+
+	req.Header.Set("Authorization", "AWS4-HMAC-SHA256 Credential=" + b.AccessKey + "/" + scope +
+		", SignedHeaders=" + signed + ", Signature=" + sig)
+}
+
+func (b *S3) request(method, key string, query url.Values, body io.Reader, size int64, rng string) (*http.Response, error) {
+	u, err := url.Parse(b.Endpoint)
+	if err != nil {
+		return nil, err
+	}
+	path := "/" + b.Bucket + "/"
+	if key != "" {
+		path += b.Prefix + key
+	}
+	u.Path = path
+	u.RawPath = awsEscape(path, true)
+	if query != nil {
+		u.RawQuery = canonicalQuery(query)
+	}
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	if rng != "" {
+		req.Header.Set("Range", rng)
+	}
+	b.sign(req)
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && method == "DELETE" {
+		// AWS answers 204 for keys which don't exist, but not every server
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode / 100 != 2 {
+		t, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		resp.Body.Close()
+		return nil, fmt.Errorf("s3 %s %s: %s %s", method, key, resp.Status, strings.TrimSpace(string(t)))
+	}
+	return resp, nil
+}
+
+func (b *S3) Upload(src, name string) (string, error) {
+	b.begin()
+	defer b.end()
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	s1 := randstr()
+	s2 := randstr()
+	fo := fmt.Sprintf("%06x", rand.Intn(1 << 24))
+	dir := s1 + "/" + s2 + "/"
+	key := dir + fo + "_" + name
+	fmt.Println("upload", src, s1, s2)
+	resp, err := b.request("PUT", key, nil, f, s.Size(), "")
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	fmt.Println("upload ok", src, s1, s2)
+	return key + "|" + dir + fo, nil
+}
+
+func (b *S3) Download(source string, writer io.Writer) error {
+	b.begin()
+	defer b.end()
+	resp, err := b.request("GET", sourceId(source), nil, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(writer, resp.Body)
+	return err
+}
+
+func (b *S3) DownloadRange(source string, offset, length uint64, writer io.Writer) error {
+	b.begin()
+	defer b.end()
+	resp, err := b.request("GET", sourceId(source), nil, nil, 0, rangeHeader(offset, length))
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return copyRange(resp, offset, length, writer)
+}
+
+func (b *S3) Delete(source string) error {
+	resp, err := b.request("DELETE", sourceId(source), nil, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *S3) Stat(source string) (Object, error) {
+	key := sourceId(source)
+	resp, err := b.request("HEAD", key, nil, nil, 0, "")
+	if err != nil {
+		return Object{}, err
+	}
+	resp.Body.Close()
+	return Object{source, key[strings.LastIndex(key, "/") + 1:], uint64(resp.ContentLength)}, nil
+}
+
+type s3Content struct {
+	Key string
+	Size int64
+}
+
+type s3ListResult struct {
+	Contents []s3Content
+	IsTruncated bool
+	NextContinuationToken string
+}
+
+// listKeys lists every object whose key starts with Prefix + prefix.
+func (b *S3) listKeys(prefix string) ([]s3Content, error) {
+	res := make([]s3Content, 0)
+	token := ""
+	for true {
+		query := url.Values{}
+		query.Set("list-type", "2")
+		query.Set("prefix", b.Prefix + prefix)
+		if token != "" {
+			query.Set("continuation-token", token)
+		}
+		resp, err := b.request("GET", "", query, nil, 0, "")
+		if err != nil {
+			return nil, err
+		}
+		var r s3ListResult
+		err = xml.NewDecoder(resp.Body).Decode(&r)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, r.Contents...)
+		token = r.NextContinuationToken
+		if !r.IsTruncated || token == "" {
+			break
+		}
+	}
+	return res, nil
+}
+
+func (b *S3) List() ([]Object, error) {
+	t, err := b.listKeys("")
+	if err != nil {
+		return nil, err
+	}
+	res := make([]Object, 0)
+	for _, c := range t {
+		key := strings.TrimPrefix(c.Key, b.Prefix)
+		s := strings.Split(key, "/")
+		if len(s) != 3 {
+			continue
+		}
+		pos := strings.Index(s[2], "_")
+		if pos == -1 {
+			continue
+		}
+		res = append(res, Object{key + "|" + s[0] + "/" + s[1] + "/" + s[2][:pos], s[2], uint64(c.Size)})
+	}
+	return res, nil
+}
+
+func (b *S3) PutMeta(name string, data []byte) error {
+	resp, err := b.request("PUT", META_DIR + name, nil, bytes.NewReader(data), int64(len(data)), "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *S3) GetMeta(name string) ([]byte, error) {
+	resp, err := b.request("GET", META_DIR + name, nil, nil, 0, "")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (b *S3) ListMeta() ([]string, error) {
+	t, err := b.listKeys(META_DIR)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	for _, c := range t {
+		res = append(res, strings.TrimPrefix(c.Key, b.Prefix + META_DIR))
+	}
+	return res, nil
+}
+
+func (b *S3) DeleteMeta(name string) error {
+	resp, err := b.request("DELETE", META_DIR + name, nil, nil, 0, "")
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,199 @@
+package backend
+
+import (
+	"errors"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Priorities of the transfers waiting for a slot, the lower first.
+const (
+	PRIO_READ = iota // a read on the mount waits for it
+	PRIO_PREFETCH // a block cached in the background, a repair
+	PRIO_UPLOAD
+)
+
+// Uploads and the rest have their own slots, so that uploads never hold
+// back reads.
+const (
+	LANE_DOWN = iota
+	LANE_UP
+)
+
+// SLOTS is how many transfers an account does at once in each lane, it can
+// be changed with -slots.
+const SLOTS = 2
+
+var Slots = SLOTS
+
+// WAIT_MAX is how long a transfer waits for an account which can't be used
+// now, like one rate limited. Those out for longer (suspended, out of daily
+// uploads, full...) are left out.
+const WAIT_MAX = 10 * time.Minute
+
+// ErrNoAccount is returned by Acquire when none of the accounts the transfer
+// may take can be used within WAIT_MAX (see account.go), instead of waiting
+// for one forever.
+var ErrNoAccount = errors.New("no account can be used")
+
+func lane(prio int) int {
+	if prio == PRIO_UPLOAD {
+		return LANE_UP
+	}
+	return LANE_DOWN
+}
+
+// Scheduler hands out the accounts of a backend to transfers, Slots at once
+// per account and lane. A transfer which has to wait gets a channel, and is
+// given a slot as soon as one is released, before those of a lower priority
+// and after those which came before it.
+type Scheduler struct {
+	mutex sync.Mutex
+	idle *sync.Cond
+	busy [][2]int
+	n int
+	queue []*ticket
+	seq uint64
+	// dispatches again when the first account waited for can be used
+	timer *time.Timer
+	timerAt time.Time
+}
+
+type ticket struct {
+	prio int
+	seq uint64
+	sid int
+	usable func(sid int) time.Time
+	ch chan int
+}
+
+func newScheduler(accounts int) *Scheduler {
+	s := &Scheduler{busy: make([][2]int, accounts)}
+	s.idle = sync.NewCond(&s.mutex)
+	return s
+}
+
+// Acquire waits for a slot on account sid, or on any account if sid is -1,
+// and returns the account. usable tells from when an account can be taken,
+// any time if it is nil. It fails with ErrNoAccount if there is no such
+// account, or none of them can be used within WAIT_MAX while it waits.
+func (s *Scheduler) Acquire(prio, sid int, usable func(sid int) time.Time) (int, error) {
+	t := &ticket{prio, 0, sid, usable, make(chan int, 1)}
+	s.mutex.Lock()
+	t.seq = s.seq
+	s.seq++
+	s.queue = append(s.queue, t)
+	s.dispatch()
+	s.mutex.Unlock()
+	res := <-t.ch
+	if res == -1 {
+		return -1, ErrNoAccount
+	}
+	return res, nil
+}
+
+func (s *Scheduler) Release(sid, prio int) {
+	s.mutex.Lock()
+	s.busy[sid][lane(prio)]--
+	s.n--
+	s.dispatch()
+	s.mutex.Unlock()
+}
+
+// Wait blocks until no transfer is running or waiting for a slot.
+func (s *Scheduler) Wait() {
+	s.mutex.Lock()
+	for s.n > 0 || len(s.queue) > 0 {
+		s.idle.Wait()
+	}
+	s.mutex.Unlock()
+}
+
+// pick returns the least busy account t can have, -1 if none has a free
+// slot, and whether t can have any account at all, free or not. If it can't
+// now, at is when the first account it may wait for can be used.
+func (s *Scheduler) pick(t *ticket, now time.Time) (res int, ok bool, at time.Time) {
+	l := lane(t.prio)
+	res = -1
+	for _, i := range rand.Perm(len(s.busy)) {
+		if t.sid != -1 && i != t.sid {
+			continue
+		}
+		if t.usable != nil {
+			if u := t.usable(i); u.After(now) {
+				if u.Sub(now) <= WAIT_MAX && (at.IsZero() || u.Before(at)) {
+					at = u
+				}
+				continue
+			}
+		}
+		ok = true
+		if s.busy[i][l] >= Slots {
+			continue
+		}
+		if res == -1 || s.busy[i][l] < s.busy[res][l] {
+			res = i
+		}
+	}
+	return res, ok, at
+}
+
+// wake has dispatch run again at at. s.mutex must be held.
+func (s *Scheduler) wake(at time.Time) {
+	if s.timer != nil && !at.Before(s.timerAt) {
+		return
+	}
+	if s.timer != nil {
+		s.timer.Stop()
+	}
+	var tm *time.Timer
+	tm = time.AfterFunc(time.Until(at), func() {
+		s.mutex.Lock()
+		if s.timer == tm {
+			s.timer = nil
+		}
+		s.dispatch()
+		s.mutex.Unlock()
+	})
+	s.timer = tm
+	s.timerAt = at
+}
+
+// dispatch gives the free slots to the tickets waiting. s.mutex must be
+// held.
+func (s *Scheduler) dispatch() {
+	sort.SliceStable(s.queue, func(i, j int) bool {
+		if s.queue[i].prio != s.queue[j].prio {
+			return s.queue[i].prio < s.queue[j].prio
+		}
+		return s.queue[i].seq < s.queue[j].seq
+	})
+	now := time.Now()
+	left := s.queue[:0]
+	for _, t := range s.queue {
+		sid, ok, at := s.pick(t, now)
+		if !ok && at.IsZero() {
+			t.ch <- -1
+			continue
+		}
+		if sid == -1 && !at.IsZero() {
+			s.wake(at)
+		}
+		if sid == -1 {
+			left = append(left, t)
+			continue
+		}
+		s.busy[sid][lane(t.prio)]++
+		s.n++
+		t.ch <- sid
+	}
+	for i := len(left); i < len(s.queue); i++ {
+		s.queue[i] = nil
+	}
+	s.queue = left
+	if s.n == 0 && len(s.queue) == 0 {
+		s.idle.Broadcast()
+	}
+}
@@ -0,0 +1,130 @@
+package backend
+
+import (
+	"testing"
+	"time"
+)
+
+func TestAcquireNoAccount(t *testing.T) {
+	if _, err := newScheduler(0).Acquire(PRIO_READ, -1, nil); err != ErrNoAccount {
+		t.Fatal(err)
+	}
+	s := newScheduler(2)
+	out := func(int) time.Time { return time.Now().Add(WAIT_MAX + time.Hour) }
+	if _, err := s.Acquire(PRIO_READ, -1, out); err != ErrNoAccount {
+		t.Fatal(err)
+	}
+	if _, err := s.Acquire(PRIO_UPLOAD, 5, nil); err != ErrNoAccount {
+		t.Fatal(err)
+	}
+}
+
+// A transfer waits for an account backed off for a while.
+func TestAcquireBackoff(t *testing.T) {
+	s := newScheduler(2)
+	start := time.Now()
+	until := []time.Time{start.Add(50 * time.Millisecond), start.Add(WAIT_MAX + time.Hour)}
+	sid, err := s.Acquire(PRIO_READ, -1, func(i int) time.Time { return until[i] })
+	if sid != 0 || err != nil {
+		t.Fatal(sid, err)
+	}
+	if time.Since(start) < 50 * time.Millisecond {
+		t.Fatal("account taken before it could be used")
+	}
+	s.Release(sid, PRIO_READ)
+}
+
+// Wait returns once the transfers waiting for a slot are done too.
+func TestWaitQueued(t *testing.T) {
+	s := newScheduler(1)
+	busy := make([]int, 0)
+	for i := 0; i < Slots; i++ {
+		sid, err := s.Acquire(PRIO_READ, -1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		busy = append(busy, sid)
+	}
+	got := make(chan int)
+	go func() {
+		sid, _ := s.Acquire(PRIO_READ, -1, nil)
+		got <- sid
+	}()
+	for true {
+		s.mutex.Lock()
+		n := len(s.queue)
+		s.mutex.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	done := make(chan bool)
+	go func() {
+		s.Wait()
+		done <- true
+	}()
+	for _, sid := range busy {
+		s.Release(sid, PRIO_READ)
+	}
+	sid := <-got
+	select {
+	case <-done:
+		t.Fatal("Wait returned with a transfer running")
+	case <-time.After(50 * time.Millisecond):
+	}
+	s.Release(sid, PRIO_READ)
+	<-done
+}
+
+// A released slot goes to the waiting transfer of the highest priority, and
+// uploads have slots of their own.
+func TestAcquireOrder(t *testing.T) {
+	s := newScheduler(1)
+	busy := make([]int, 0)
+	for i := 0; i < Slots; i++ {
+		sid, err := s.Acquire(PRIO_READ, -1, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		busy = append(busy, sid)
+	}
+	got := make(chan int, 2)
+	go func() {
+		s.Acquire(PRIO_PREFETCH, -1, nil)
+		got <- PRIO_PREFETCH
+	}()
+	for true {
+		s.mutex.Lock()
+		n := len(s.queue)
+		s.mutex.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	go func() {
+		s.Acquire(PRIO_READ, 0, nil)
+		got <- PRIO_READ
+	}()
+	for true {
+		s.mutex.Lock()
+		n := len(s.queue)
+		s.mutex.Unlock()
+		if n == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	if sid, err := s.Acquire(PRIO_UPLOAD, -1, nil); sid != 0 || err != nil {
+		t.Fatal("upload got", sid, err)
+	}
+	s.Release(busy[0], PRIO_READ)
+	if p := <-got; p != PRIO_READ {
+		t.Fatal("first slot went to", p)
+	}
+	s.Release(busy[1], PRIO_READ)
+	if p := <-got; p != PRIO_PREFETCH {
+		t.Fatal("second slot went to", p)
+	}
+}
@@ -0,0 +1,369 @@
+package backend
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"net/http"
+	"net/url"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+const WEBDAV_CONFIG_FILE = "webdav_config"
+
+func init() {
+	register("webdav", func() Backend { return &WebDAV{} })
+}
+
+// WebDAV stores blocks on a WebDAV server such as Nextcloud, with the same
+// s1/s2 directory layout as on Drive. Sources look like
+// "s1/s2/fo_name|s1/s2/fo", the part before "|" being relative to URL.
+type WebDAV struct {
+	URL string `json:"url"`
+	User string `json:"user"`
+	Password string `json:"password"`
+	base *url.URL
+	client *http.Client
+	dirs map[string]bool
+	dirMutex sync.Mutex
+	running
+}
+
+func (b *WebDAV) Load() {
+	t, err := ioutil.ReadFile(WEBDAV_CONFIG_FILE)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = json.Unmarshal(t, b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if !strings.HasSuffix(b.URL, "/") {
+		b.URL += "/"
+	}
+	b.base, err = url.Parse(b.URL)
+	if err != nil {
+		log.Fatal(err)
+	}
+	b.client = &http.Client{Transport: &http.Transport{
+		MaxIdleConns: 200,
+		MaxIdleConnsPerHost: 200,
+	}}
+	b.dirs = make(map[string]bool)
+	fmt.Println("webdav load ok")
+}
+
+func (b *WebDAV) Save() {
+}
+
+func (b *WebDAV) request(method, rel string, body io.Reader, size int64, header map[string]string) (*http.Response, error) {
+	u := *b.base
+	u.Path = b.base.Path + rel
+	u.RawPath = ""
+	req, err := http.NewRequest(method, u.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	if body != nil {
+		req.ContentLength = size
+	}
+	for k, v := range header {
+		req.Header.Set(k, v)
+	}
+	if b.User != "" {
+		req.SetBasicAuth(b.User, b.Password)
+	}
+	return b.client.Do(req)
+}
+
+func (b *WebDAV) do(method, rel string, body io.Reader, size int64, header map[string]string) (*http.Response, error) {
+	resp, err := b.request(method, rel, body, size, header)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode == http.StatusNotFound && method == "DELETE" {
+		resp.Body.Close()
+		return nil, ErrNotFound
+	}
+	if resp.StatusCode / 100 != 2 {
+		resp.Body.Close()
+		return nil, fmt.Errorf("webdav %s %s: %s", method, rel, resp.Status)
+	}
+	return resp, nil
+}
+
+// mkcol creates the directory rel unless it is known to exist already.
+func (b *WebDAV) mkcol(rel string) error {
+	b.dirMutex.Lock()
+	defer b.dirMutex.Unlock()
+	if b.dirs[rel] {
+		return nil
+	}
+	resp, err := b.request("MKCOL", rel, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	// 405 Method Not Allowed is what servers answer for existing collections
+	if resp.StatusCode / 100 != 2 && resp.StatusCode != http.StatusMethodNotAllowed {
+		return fmt.Errorf("webdav MKCOL %s: %s", rel, resp.Status)
+	}
+	b.dirs[rel] = true
+	return nil
+}
+
+func (b *WebDAV) Upload(src, name string) (string, error) {
+	b.begin()
+	defer b.end()
+	f, err := os.Open(src)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	s, err := f.Stat()
+	if err != nil {
+		return "", err
+	}
+	s1 := randstr()
+	s2 := randstr()
+	fmt.Println("upload", src, s1, s2)
+	err = b.mkcol(s1 + "/")
+	if err != nil {
+		return "", err
+	}
+	dir := s1 + "/" + s2 + "/"
+	err = b.mkcol(dir)
+	if err != nil {
+		return "", err
+	}
+	fo := fmt.Sprintf("%06x", rand.Intn(1 << 24))
+	id := dir + fo + "_" + name
+	resp, err := b.do("PUT", id, f, s.Size(), nil)
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	fmt.Println("upload ok", src, s1, s2)
+	return id + "|" + dir + fo, nil
+}
+
+func (b *WebDAV) Download(source string, writer io.Writer) error {
+	b.begin()
+	defer b.end()
+	resp, err := b.do("GET", sourceId(source), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	_, err = io.Copy(writer, resp.Body)
+	return err
+}
+
+func (b *WebDAV) DownloadRange(source string, offset, length uint64, writer io.Writer) error {
+	b.begin()
+	defer b.end()
+	resp, err := b.do("GET", sourceId(source), nil, 0, map[string]string{"Range": rangeHeader(offset, length)})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	return copyRange(resp, offset, length, writer)
+}
+
+func (b *WebDAV) Delete(source string) error {
+	resp, err := b.do("DELETE", sourceId(source), nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+type davResponse struct {
+	Href string `xml:"href"`
+	Length int64 `xml:"propstat>prop>getcontentlength"`
+	Collection *struct{} `xml:"propstat>prop>resourcetype>collection"`
+}
+
+type davMultistatus struct {
+	Responses []davResponse `xml:"response"`
+}
+
+const davPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:resourcetype/><d:getcontentlength/></d:prop></d:propfind>`
+
+// propfind returns the entries of rel with Depth 1, or rel itself with
+// Depth 0, keyed by their names.
+func (b *WebDAV) propfind(rel, depth string) (map[string]davResponse, error) {
+	resp, err := b.do("PROPFIND", rel, strings.NewReader(davPropfind), int64(len(davPropfind)), map[string]string{
+		"Depth": depth,
+		"Content-Type": "application/xml; charset=utf-8",
+	})
+	if err != nil {
+		return nil, err
+	}
+	var r davMultistatus
+	err = xml.NewDecoder(resp.Body).Decode(&r)
+	resp.Body.Close()
+	if err != nil {
+		return nil, err
+	}
+	self := strings.TrimSuffix(b.base.Path + rel, "/")
+	res := make(map[string]davResponse)
+	for _, t := range r.Responses {
+		u, err := url.Parse(t.Href)
+		if err != nil {
+			continue
+		}
+		p := strings.TrimSuffix(u.Path, "/")
+		if depth != "0" && p == self {
+			continue
+		}
+		res[path.Base(p)] = t
+	}
+	return res, nil
+}
+
+const davQuotaPropfind = `<?xml version="1.0" encoding="utf-8"?>
+<d:propfind xmlns:d="DAV:"><d:prop><d:quota-available-bytes/><d:quota-used-bytes/></d:prop></d:propfind>`
+
+type davQuota struct {
+	Available *int64 `xml:"response>propstat>prop>quota-available-bytes"`
+	Used int64 `xml:"response>propstat>prop>quota-used-bytes"`
+}
+
+// Quota asks the server for the quota of the folder (RFC 4331), which not
+// every one tells.
+func (b *WebDAV) Quota() (uint64, uint64, error) {
+	resp, err := b.do("PROPFIND", "", strings.NewReader(davQuotaPropfind), int64(len(davQuotaPropfind)), map[string]string{
+		"Depth": "0",
+		"Content-Type": "application/xml; charset=utf-8",
+	})
+	if err != nil {
+		return 0, 0, err
+	}
+	var r davQuota
+	err = xml.NewDecoder(resp.Body).Decode(&r)
+	resp.Body.Close()
+	if err != nil {
+		return 0, 0, err
+	}
+	// a negative amount means unknown or unlimited
+	if r.Available == nil || *r.Available < 0 || r.Used < 0 {
+		return 0, 0, nil
+	}
+	return uint64(*r.Available + r.Used), uint64(r.Used), nil
+}
+
+func (b *WebDAV) Stat(source string) (Object, error) {
+	id := sourceId(source)
+	r, err := b.propfind(id, "0")
+	if err != nil {
+		return Object{}, err
+	}
+	name := path.Base(id)
+	t, ok := r[name]
+	if !ok {
+		return Object{}, fmt.Errorf("webdav PROPFIND %s: no such file", id)
+	}
+	return Object{source, name, uint64(t.Length)}, nil
+}
+
+func (b *WebDAV) List() ([]Object, error) {
+	res := make([]Object, 0)
+	l1, err := b.propfind("", "1")
+	if err != nil {
+		return nil, err
+	}
+	for s1, a := range l1 {
+		if a.Collection == nil {
+			continue
+		}
+		l2, err := b.propfind(s1 + "/", "1")
+		if err != nil {
+			return nil, err
+		}
+		for s2, c := range l2 {
+			if c.Collection == nil {
+				continue
+			}
+			dir := s1 + "/" + s2 + "/"
+			l3, err := b.propfind(dir, "1")
+			if err != nil {
+				return nil, err
+			}
+			for name, t := range l3 {
+				pos := strings.Index(name, "_")
+				if t.Collection != nil || pos == -1 {
+					continue
+				}
+				res = append(res, Object{dir + name + "|" + dir + name[:pos], name, uint64(t.Length)})
+			}
+		}
+	}
+	return res, nil
+}
+
+func (b *WebDAV) PutMeta(name string, data []byte) error {
+	err := b.mkcol(META_DIR)
+	if err != nil {
+		return err
+	}
+	resp, err := b.do("PUT", META_DIR + name, bytes.NewReader(data), int64(len(data)), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+func (b *WebDAV) GetMeta(name string) ([]byte, error) {
+	resp, err := b.do("GET", META_DIR + name, nil, 0, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	return ioutil.ReadAll(resp.Body)
+}
+
+func (b *WebDAV) ListMeta() ([]string, error) {
+	resp, err := b.request("PROPFIND", META_DIR, strings.NewReader(davPropfind), int64(len(davPropfind)), map[string]string{
+		"Depth": "0",
+		"Content-Type": "application/xml; charset=utf-8",
+	})
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	t, err := b.propfind(META_DIR, "1")
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	for name, a := range t {
+		if a.Collection == nil {
+			res = append(res, name)
+		}
+	}
+	return res, nil
+}
+
+func (b *WebDAV) DeleteMeta(name string) error {
+	resp, err := b.do("DELETE", META_DIR + name, nil, 0, nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
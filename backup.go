@@ -0,0 +1,233 @@
+package main
+
+import (
+	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"./backend"
+)
+
+// Copies of fs_data are uploaded to the META_DIR of backends which are a
+// MetaStore, every BACKUP_INTERVAL while mounted and after copy, fix, repack
+// and gc, the last BACKUP_KEEP being kept. A copy is BACKUP_MAGIC, a flags
+// byte, and fs_data; when KEY_FILE exists it is encrypted, the salt and the
+// nonce coming before it.
+const BACKUP_MAGIC = "seeefsb\x00"
+const BACKUP_PREFIX = "fs_data_"
+const BACKUP_TIME = "20060102T150405Z"
+const BACKUP_INTERVAL = 1 * time.Hour
+const BACKUP_KEEP = 24
+
+const BACKUP_ENCRYPTED byte = 1
+
+var lastBackup [sha256.Size]byte
+var BackupMutex sync.Mutex
+
+var errNoMetaStore = errors.New("the backend can't keep copies of fs_data")
+
+func sealBackup(t []byte) []byte {
+	aead := getAEAD()
+	res := []byte(BACKUP_MAGIC)
+	if aead == nil {
+		return append(append(res, 0), t...)
+	}
+	FSMutex.Lock()
+	salt := CryptSalt
+	FSMutex.Unlock()
+	res = append(res, BACKUP_ENCRYPTED)
+	res = append(res, salt[:]...)
+	nonce := make([]byte, aead.NonceSize())
+	rand.Read(nonce)
+	res = append(res, nonce...)
+	return aead.Seal(res, nonce, t, res[:len(BACKUP_MAGIC) + 1])
+}
+
+// openBackup returns the fs_data in copy s.
+func openBackup(s []byte) ([]byte, error) {
+	if len(s) < len(BACKUP_MAGIC) + 1 || string(s[:len(BACKUP_MAGIC)]) != BACKUP_MAGIC {
+		return nil, errors.New("not a copy of fs_data")
+	}
+	n := len(BACKUP_MAGIC) + 1
+	if s[n - 1] & BACKUP_ENCRYPTED == 0 {
+		return s[n:], nil
+	}
+	var salt [16]byte
+	if len(s) < n + 16 {
+		return nil, errTruncated
+	}
+	copy(salt[:], s[n:])
+	aead := deriveAEAD(salt)
+	if aead == nil {
+		return nil, errors.New("copy is encrypted but " + KEY_FILE + " is missing")
+	}
+	if len(s) < n + 16 + aead.NonceSize() {
+		return nil, errTruncated
+	}
+	nonce := s[n + 16: n + 16 + aead.NonceSize()]
+	res, err := aead.Open(nil, nonce, s[n + 16 + aead.NonceSize():], s[:n])
+	if err != nil {
+		return nil, errors.New("can't decrypt the copy, wrong passphrase?")
+	}
+	return res, nil
+}
+
+func metaStore() (backend.MetaStore, error) {
+	ms, ok := Remote.(backend.MetaStore)
+	if !ok {
+		return nil, errNoMetaStore
+	}
+	return ms, nil
+}
+
+// listBackups returns the names of the copies, oldest first.
+func listBackups(ms backend.MetaStore) ([]string, error) {
+	t, err := ms.ListMeta()
+	if err != nil {
+		return nil, err
+	}
+	res := make([]string, 0)
+	for _, name := range t {
+		if strings.HasPrefix(name, BACKUP_PREFIX) {
+			res = append(res, name)
+		}
+	}
+	sort.Strings(res)
+	return res, nil
+}
+
+// backupMeta uploads a copy of fs_data as it is now, unless it is the same as
+// the last one. It returns the name of the copy, "" if there was no need.
+func backupMeta() (string, error) {
+	ms, err := metaStore()
+	if err != nil {
+		return "", err
+	}
+	BackupMutex.Lock()
+	defer BackupMutex.Unlock()
+	FSMutex.Lock()
+	JournalMutex.Lock()
+	t := saveBytes()
+	JournalMutex.Unlock()
+	FSMutex.Unlock()
+	h := sha256.Sum256(t)
+	if h == lastBackup {
+		return "", nil
+	}
+	name := BACKUP_PREFIX + time.Now().UTC().Format(BACKUP_TIME)
+	err = ms.PutMeta(name, sealBackup(t))
+	if err != nil {
+		return "", err
+	}
+	lastBackup = h
+	names, err := listBackups(ms)
+	if err != nil {
+		return name, err
+	}
+	for i := 0; i + BACKUP_KEEP < len(names); i++ {
+		err = ms.DeleteMeta(names[i])
+		if err != nil {
+			return name, err
+		}
+	}
+	return name, nil
+}
+
+// autoBackup is backupMeta for the copies made on the way, which only log.
+func autoBackup() {
+	name, err := backupMeta()
+	if err == errNoMetaStore {
+		return
+	}
+	if err != nil {
+		log.Print("backup of fs_data: ", err)
+	} else if name != "" {
+		log.Print("fs_data backed up as ", backend.META_DIR + name)
+	}
+}
+
+func backupLoop() {
+	for true {
+		time.Sleep(BACKUP_INTERVAL)
+		if Writer {
+			autoBackup()
+		}
+	}
+}
+
+// restoreMain rebuilds fs_data from copy name, the latest one if name is
+// empty. What it replaces is kept with a .bak suffix.
+func restoreMain(name string) {
+	lockFS(true)
+	ms, err := metaStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	names, err := listBackups(ms)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if name == "" {
+		if len(names) == 0 {
+			log.Fatal("no copy of fs_data in ", backend.META_DIR)
+		}
+		name = names[len(names) - 1]
+	}
+	s, err := ms.GetMeta(name)
+	if err != nil {
+		log.Fatal(err)
+	}
+	t, err := openBackup(s)
+	if err == nil {
+		_, err = decodeState(t)
+	}
+	if err != nil {
+		log.Fatal(name, ": ", err)
+	}
+	if old, err := ioutil.ReadFile(FS_DATA_FILE); err == nil && bytes.Equal(old, t) {
+		fmt.Println("fs_data is the same as", name)
+		return
+	}
+	// the journal and the gc plan are about the old fs_data, and the cache
+	// index may be about other block numbers
+	for _, f := range []string{FS_DATA_FILE, JOURNAL_FILE, GC_PLAN_FILE, CACHE_INDEX_FILE} {
+		err = os.Rename(f, f + ".bak")
+		if err != nil && !os.IsNotExist(err) {
+			log.Fatal(err)
+		}
+	}
+	writeFSData(t)
+	fmt.Println("fs_data restored from", name)
+}
+
+// backupMain makes a copy now, or lists them.
+func backupMain(list bool) {
+	ms, err := metaStore()
+	if err != nil {
+		log.Fatal(err)
+	}
+	if list {
+		names, err := listBackups(ms)
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return
+	}
+	name, err := backupMeta()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("fs_data backed up as", backend.META_DIR + name)
+}
@@ -0,0 +1,670 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+
+	"./backend"
+)
+
+// The cache file of a node is a sparse file of the node's size, of which
+// only some chunks of CACHE_CHUNK_SIZE bytes may be present.
+const (
+	CHUNK_ABSENT byte = iota
+	CHUNK_FETCHING
+	CHUNK_PRESENT
+)
+
+var NodesOpenCnt []uint64
+var NodesLastAccess []uint64
+var NodesRangeRead []uint64
+var NodesFilling []bool
+var NodesCacheSize []uint64
+var NodesChunks [][]byte
+var NodesChunksAccess [][]uint64
+var NodesVerified, NodesBad []bool
+var NodesVerifyFails []uint64
+
+var errBadNode = errors.New("block failed verification")
+var errLostNode = errors.New("block is neither uploaded nor in " + TMP_PATH)
+
+var CachedNodes []uint64
+var CacheListMutex sync.Mutex
+var CacheCond = sync.NewCond(&CacheListMutex)
+var CacheTotalSize uint64
+
+func cacheFileName(id uint64) string {
+	return CACHE_PATH + strconv.FormatUint(id, 10)
+}
+
+func nowMs() uint64 {
+	return uint64(time.Now().UnixNano() / int64(time.Millisecond))
+}
+
+func chunkCount(size uint64) uint64 {
+	return (size + CACHE_CHUNK_SIZE - 1) / CACHE_CHUNK_SIZE
+}
+
+func chunkSize(size, c uint64) uint64 {
+	if (c + 1) * CACHE_CHUNK_SIZE > size {
+		return size - c * CACHE_CHUNK_SIZE
+	}
+	return CACHE_CHUNK_SIZE
+}
+
+// resizeNodeState makes the per node cache state fit n nodes, keeping the
+// state of the nodes which already exist.
+func resizeNodeState(n int) {
+	t := make([]uint64, n)
+	copy(t, NodesOpenCnt)
+	NodesOpenCnt = t
+	t = make([]uint64, n)
+	copy(t, NodesLastAccess)
+	NodesLastAccess = t
+	t = make([]uint64, n)
+	copy(t, NodesRangeRead)
+	NodesRangeRead = t
+	t = make([]uint64, n)
+	copy(t, NodesCacheSize)
+	NodesCacheSize = t
+	t2 := make([]bool, n)
+	copy(t2, NodesFilling)
+	NodesFilling = t2
+	t3 := make([][]byte, n)
+	copy(t3, NodesChunks)
+	NodesChunks = t3
+	t4 := make([][]uint64, n)
+	copy(t4, NodesChunksAccess)
+	NodesChunksAccess = t4
+	t2 = make([]bool, n)
+	copy(t2, NodesVerified)
+	NodesVerified = t2
+	t2 = make([]bool, n)
+	copy(t2, NodesBad)
+	NodesBad = t2
+	t = make([]uint64, n)
+	copy(t, NodesVerifyFails)
+	NodesVerifyFails = t
+}
+
+// renumberNodeState moves the cache of every node id to newId[id], renaming
+// the cache files, and drops it for nodes whose new id is NullId. New ids
+// must be increasing and never above the old ones, as gc makes them.
+func renumberNodeState(newId []uint64) {
+	CacheListMutex.Lock()
+	for id := 0; id < len(newId); id++ {
+		if newId[id] == NullId && NodesChunks[id] != nil {
+			dropCache(uint64(id))
+		}
+	}
+	n := 0
+	for id := 0; id < len(newId); id++ {
+		j := newId[id]
+		if j == NullId {
+			continue
+		}
+		n = int(j) + 1
+		if j == uint64(id) {
+			continue
+		}
+		if NodesChunks[id] != nil {
+			err := os.Rename(cacheFileName(uint64(id)), cacheFileName(j))
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		NodesOpenCnt[j] = NodesOpenCnt[id]
+		NodesLastAccess[j] = NodesLastAccess[id]
+		NodesRangeRead[j] = NodesRangeRead[id]
+		NodesFilling[j] = NodesFilling[id]
+		NodesCacheSize[j] = NodesCacheSize[id]
+		NodesChunks[j] = NodesChunks[id]
+		NodesChunksAccess[j] = NodesChunksAccess[id]
+		NodesVerified[j] = NodesVerified[id]
+		NodesBad[j] = NodesBad[id]
+		NodesVerifyFails[j] = NodesVerifyFails[id]
+		NodesChunks[id] = nil
+	}
+	for i := 0; i < len(CachedNodes); i++ {
+		CachedNodes[i] = newId[CachedNodes[i]]
+	}
+	resizeNodeState(n)
+	CacheListMutex.Unlock()
+}
+
+// initCache creates the empty cache file of node id if it has none yet.
+// CacheListMutex must be held.
+func initCache(id, size uint64) {
+	if NodesChunks[id] != nil {
+		return
+	}
+	f, err := os.OpenFile(cacheFileName(id), os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	f.Truncate(int64(size))
+	f.Close()
+	NodesCacheSize[id] = size
+	NodesChunks[id] = make([]byte, chunkCount(size))
+	NodesChunksAccess[id] = make([]uint64, chunkCount(size))
+	CachedNodes = append(CachedNodes, id)
+}
+
+// dropCache removes the cache file of node id. CacheListMutex must be held.
+func dropCache(id uint64) {
+	for i := 0; i < len(CachedNodes); i++ {
+		if CachedNodes[i] == id {
+			CachedNodes[i] = CachedNodes[len(CachedNodes) - 1]
+			CachedNodes = CachedNodes[:len(CachedNodes) - 1]
+			break
+		}
+	}
+	NodesChunks[id] = nil
+	NodesChunksAccess[id] = nil
+	NodesRangeRead[id] = 0
+	NodesVerified[id] = false
+	os.Remove(cacheFileName(id))
+	//fmt.Println("/remove node", id)
+}
+
+// evictNode frees the least recently used chunks of node id until need more
+// bytes fit in the cache, and drops the file once nothing is left in it.
+// It returns false if nothing could be freed. CacheListMutex must be held.
+func evictNode(id, need uint64) bool {
+	st := NodesChunks[id]
+	acc := NodesChunksAccess[id]
+	size := NodesCacheSize[id]
+	f, err := os.OpenFile(cacheFileName(id), os.O_WRONLY, 0644)
+	if err != nil {
+		log.Print(err)
+	}
+	freed := false
+	for CacheTotalSize + need > CACHE_LIMIT {
+		c := -1
+		for i := 0; i < len(st); i++ {
+			if st[i] == CHUNK_PRESENT && (c == -1 || acc[i] < acc[c]) {
+				c = i
+			}
+		}
+		if c == -1 {
+			break
+		}
+		if f != nil {
+			punchHole(f, uint64(c) * CACHE_CHUNK_SIZE, chunkSize(size, uint64(c)))
+		}
+		st[c] = CHUNK_ABSENT
+		CacheTotalSize -= chunkSize(size, uint64(c))
+		NodesVerified[id] = false
+		freed = true
+	}
+	if f != nil {
+		f.Close()
+	}
+	left := false
+	for i := 0; i < len(st); i++ {
+		if st[i] != CHUNK_ABSENT {
+			left = true
+			break
+		}
+	}
+	if !left {
+		dropCache(id)
+		freed = true
+	}
+	return freed
+}
+
+// evict frees cached chunks, from the least recently used nodes which are
+// neither open nor being filled, until need more bytes fit in CACHE_LIMIT.
+// CacheListMutex must be held.
+func evict(need uint64) {
+	for CacheTotalSize + need > CACHE_LIMIT {
+		var oldest uint64 = NullId
+		pos := -1
+		for i := 0; i < len(CachedNodes); i++ {
+			t := CachedNodes[i]
+			if NodesOpenCnt[t] == 0 && !NodesFilling[t] && NodesLastAccess[t] < oldest {
+				oldest = NodesLastAccess[t]
+				pos = i
+			}
+		}
+		if pos == -1 {
+			break
+		}
+		if !evictNode(CachedNodes[pos], need) {
+			break
+		}
+	}
+}
+
+// downloadChunks reads n bytes at off of node id into its cache file. Nodes
+// not uploaded yet are read from their tmp file, reads of nodes which have
+// neither fail.
+func downloadChunks(id uint64, node Node, off, n uint64, prio int) error {
+	var err error
+	for i := 0; i < 3; i++ {
+		var buf []byte
+		buf, err = readBlock(id, node, off, n, prio)
+		if err == nil {
+			var f *os.File
+			f, err = os.OpenFile(cacheFileName(id), os.O_WRONLY, 0644)
+			if err != nil {
+				return err
+			}
+			_, err = f.WriteAt(buf, int64(off))
+			f.Close()
+			return err
+		}
+		fmt.Println(err)
+		// the tmp file is removed once the upload is done
+		FSMutex.Lock()
+		node = Nodes[id]
+		FSMutex.Unlock()
+		if !uploaded(node) && os.IsNotExist(err) {
+			return errLostNode
+		}
+		time.Sleep(1 * time.Second)
+	}
+	return err
+}
+
+// fetchChunks makes the chunks [a, b) of node id present in its cache file,
+// downloading the missing ones with priority prio and waiting for those
+// already on their way.
+func fetchChunks(id, a, b uint64, prio int) error {
+	FSMutex.Lock()
+	node := Nodes[id]
+	size := node.Size
+	FSMutex.Unlock()
+	CacheListMutex.Lock()
+	if NodesBad[id] {
+		CacheListMutex.Unlock()
+		return errBadNode
+	}
+	initCache(id, size)
+	for true {
+		st := NodesChunks[id]
+		x := a
+		for x < b && st[x] != CHUNK_ABSENT {
+			x++
+		}
+		if x == b {
+			busy := false
+			for i := a; i < b; i++ {
+				if st[i] == CHUNK_FETCHING {
+					busy = true
+					break
+				}
+			}
+			if !busy {
+				break
+			}
+			CacheCond.Wait()
+			continue
+		}
+		y := x
+		var n uint64
+		for y < b && st[y] == CHUNK_ABSENT {
+			n += chunkSize(size, y)
+			y++
+		}
+		evict(n)
+		for i := x; i < y; i++ {
+			st[i] = CHUNK_FETCHING
+		}
+		CacheTotalSize += n
+		CacheListMutex.Unlock()
+		err := downloadChunks(id, node, x * CACHE_CHUNK_SIZE, n, prio)
+		CacheListMutex.Lock()
+		for i := x; i < y; i++ {
+			if err == nil {
+				st[i] = CHUNK_PRESENT
+			} else {
+				st[i] = CHUNK_ABSENT
+			}
+		}
+		if err != nil {
+			CacheTotalSize -= n
+		}
+		CacheCond.Broadcast()
+		if err != nil {
+			CacheListMutex.Unlock()
+			return err
+		}
+	}
+	t := nowMs()
+	NodesLastAccess[id] = t
+	for i := a; i < b; i++ {
+		NodesChunksAccess[id][i] = t
+	}
+	check := !NodesVerified[id] && !NodesFilling[id] && nodeComplete(id)
+	CacheListMutex.Unlock()
+	if check {
+		// let fill verify the block
+		preCache(id)
+	}
+	return nil
+}
+
+// nodeComplete tells whether every chunk of node id is cached.
+// CacheListMutex must be held.
+func nodeComplete(id uint64) bool {
+	if NodesChunks[id] == nil {
+		return false
+	}
+	for _, c := range NodesChunks[id] {
+		if c != CHUNK_PRESENT {
+			return false
+		}
+	}
+	return true
+}
+
+// verifyNode checks a fully cached node against its hash. On mismatch the
+// cached chunks are thrown away and false is returned, unless the node has
+// failed VERIFY_RETRIES times, in which case it is marked bad.
+func verifyNode(id uint64) bool {
+	FSMutex.Lock()
+	hash := Nodes[id].Hash
+	FSMutex.Unlock()
+	CacheListMutex.Lock()
+	done := NodesVerified[id] || hash == [sha256.Size]byte{} || !nodeComplete(id)
+	CacheListMutex.Unlock()
+	if done {
+		return true
+	}
+	f, err := os.Open(cacheFileName(id))
+	if err != nil {
+		log.Print(err)
+		return true
+	}
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	f.Close()
+	if err != nil {
+		log.Print(err)
+		return true
+	}
+	var t [sha256.Size]byte
+	copy(t[:], h.Sum(nil))
+	CacheListMutex.Lock()
+	defer CacheListMutex.Unlock()
+	if t == hash {
+		NodesVerified[id] = true
+		return true
+	}
+	NodesVerifyFails[id]++
+	log.Print("node ", id, " failed verification ", NodesVerifyFails[id], " times")
+	f, err = os.OpenFile(cacheFileName(id), os.O_WRONLY, 0644)
+	if err == nil {
+		f.Truncate(0)
+		f.Truncate(int64(NodesCacheSize[id]))
+		f.Close()
+	}
+	st := NodesChunks[id]
+	for i := 0; i < len(st); i++ {
+		if st[i] == CHUNK_PRESENT {
+			st[i] = CHUNK_ABSENT
+			CacheTotalSize -= chunkSize(NodesCacheSize[id], uint64(i))
+		}
+	}
+	if NodesVerifyFails[id] >= VERIFY_RETRIES {
+		log.Print("node ", id, " is bad")
+		NodesBad[id] = true
+		return true
+	}
+	return false
+}
+
+// fill fetches every missing chunk of node id, in runs of FILL_RUN_CHUNKS,
+// then verifies the whole block.
+func fill(id uint64) {
+	FSMutex.Lock()
+	size := Nodes[id].Size
+	FSMutex.Unlock()
+	n := chunkCount(size)
+	for true {
+		failed := false
+		for c := uint64(0); c < n; c += FILL_RUN_CHUNKS {
+			e := c + FILL_RUN_CHUNKS
+			if e > n {
+				e = n
+			}
+			err := fetchChunks(id, c, e, backend.PRIO_PREFETCH)
+			if err != nil {
+				fmt.Println("fill", id, err)
+				failed = true
+				break
+			}
+		}
+		if failed || verifyNode(id) {
+			break
+		}
+	}
+	CacheListMutex.Lock()
+	NodesFilling[id] = false
+	CacheListMutex.Unlock()
+}
+
+func preCache(id uint64) {
+	CacheListMutex.Lock()
+	start := !NodesFilling[id]
+	if start {
+		NodesFilling[id] = true
+	}
+	CacheListMutex.Unlock()
+	if start {
+		go fill(id)
+	}
+}
+
+// noteRead records that n bytes of node id are being read, and fills the
+// whole block in the background when it is small or when enough of it has
+// been asked for.
+func noteRead(id, n uint64) {
+	FSMutex.Lock()
+	size := Nodes[id].Size
+	FSMutex.Unlock()
+	CacheListMutex.Lock()
+	NodesRangeRead[id] += n
+	worth := size < RANGE_MIN_BLOCK || NodesRangeRead[id] * RANGE_FILL_RATIO >= size
+	CacheListMutex.Unlock()
+	if worth {
+		preCache(id)
+	}
+}
+
+// getNodeFile opens the cache file of node id, which is kept from being
+// evicted until closeNodeFile.
+func getNodeFile(id uint64) *os.File {
+	//fmt.Println("open node", id)
+	FSMutex.Lock()
+	size := Nodes[id].Size
+	FSMutex.Unlock()
+	CacheListMutex.Lock()
+	initCache(id, size)
+	NodesOpenCnt[id]++
+	CacheListMutex.Unlock()
+	f, err := os.Open(cacheFileName(id))
+	if err != nil {
+		log.Fatal(err)
+	}
+	return f
+}
+
+func closeNodeFile(id uint64, f *os.File) {
+	//fmt.Println("close node", id)
+	f.Close()
+	CacheListMutex.Lock()
+	NodesOpenCnt[id]--
+	CacheListMutex.Unlock()
+}
+
+func preFetch(id uint64) {
+	var nid uint64
+	FSMutex.Lock()
+	if len(Files[id].Storage.Nodes) > 0 {
+		nid = Files[id].Storage.Nodes[0]
+	} else {
+		nid = Files[id].Storage.NodeId
+	}
+	small := nid < uint64(len(Nodes)) && Nodes[nid].Size < RANGE_MIN_BLOCK
+	FSMutex.Unlock()
+	if small {
+		preCache(nid)
+	}
+}
+
+// CacheEntry is how the state of a cached node is kept in CACHE_INDEX_FILE
+// between mounts.
+type CacheEntry struct {
+	Id, Size uint64
+	Source string
+	LastAccess uint64
+	Chunks []byte
+	ChunksAccess []uint64
+	Verified bool
+}
+
+func saveCacheIndex() {
+	FSMutex.Lock()
+	CacheListMutex.Lock()
+	res := make([]CacheEntry, 0, len(CachedNodes))
+	for _, id := range CachedNodes {
+		e := CacheEntry{id, NodesCacheSize[id], mainSource(Nodes[id]), NodesLastAccess[id], make([]byte, len(NodesChunks[id])), make([]uint64, len(NodesChunks[id])), false}
+		for i := 0; i < len(e.Chunks); i++ {
+			// chunks still being downloaded are not there yet
+			if NodesChunks[id][i] == CHUNK_PRESENT {
+				e.Chunks[i] = CHUNK_PRESENT
+			}
+		}
+		copy(e.ChunksAccess, NodesChunksAccess[id])
+		e.Verified = NodesVerified[id]
+		res = append(res, e)
+	}
+	CacheListMutex.Unlock()
+	FSMutex.Unlock()
+
+	tmp := CACHE_INDEX_FILE + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	err = gob.NewEncoder(f).Encode(res)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, CACHE_INDEX_FILE)
+	}
+	if err != nil {
+		log.Print(err)
+		os.Remove(tmp)
+	}
+}
+
+// loadCacheIndex adopts the cache files listed in CACHE_INDEX_FILE which
+// still match their nodes, and deletes every other file in CACHE_PATH.
+func loadCacheIndex() {
+	entries := make([]CacheEntry, 0)
+	f, err := os.Open(CACHE_INDEX_FILE)
+	if err != nil {
+		log.Print(err)
+	} else {
+		err = gob.NewDecoder(f).Decode(&entries)
+		f.Close()
+		if err != nil {
+			log.Print(err)
+			entries = entries[:0]
+		}
+	}
+	FSMutex.Lock()
+	CacheListMutex.Lock()
+	adopted := make(map[string]bool)
+	for _, e := range entries {
+		if e.Id >= uint64(len(Nodes)) || NodesChunks[e.Id] != nil {
+			continue
+		}
+		if mainSource(Nodes[e.Id]) != e.Source || Nodes[e.Id].Size != e.Size {
+			continue
+		}
+		if uint64(len(e.Chunks)) != chunkCount(e.Size) || len(e.ChunksAccess) != len(e.Chunks) {
+			continue
+		}
+		s, err := os.Stat(cacheFileName(e.Id))
+		if err != nil || uint64(s.Size()) != e.Size {
+			continue
+		}
+		NodesCacheSize[e.Id] = e.Size
+		NodesChunks[e.Id] = e.Chunks
+		NodesChunksAccess[e.Id] = e.ChunksAccess
+		NodesLastAccess[e.Id] = e.LastAccess
+		NodesVerified[e.Id] = e.Verified
+		for i := 0; i < len(e.Chunks); i++ {
+			if e.Chunks[i] == CHUNK_PRESENT {
+				CacheTotalSize += chunkSize(e.Size, uint64(i))
+			} else {
+				e.Chunks[i] = CHUNK_ABSENT
+			}
+		}
+		CachedNodes = append(CachedNodes, e.Id)
+		adopted[strconv.FormatUint(e.Id, 10)] = true
+	}
+	files, err := ioutil.ReadDir(CACHE_PATH)
+	if err != nil {
+		log.Print(err)
+	}
+	for _, t := range files {
+		if CACHE_PATH + t.Name() == CACHE_INDEX_FILE || adopted[t.Name()] {
+			continue
+		}
+		fmt.Println("remove stray cache file", t.Name())
+		os.Remove(CACHE_PATH + t.Name())
+	}
+	evict(0)
+	fmt.Println("cache index:", len(CachedNodes), "nodes,", CacheTotalSize, "bytes")
+	CacheListMutex.Unlock()
+	FSMutex.Unlock()
+}
+
+func saveCacheIndexLoop() {
+	for true {
+		time.Sleep(CACHE_INDEX_INTERVAL)
+		saveCacheIndex()
+	}
+}
+
+// cachedBytes counts the cached bytes of [off, off + n) of node id.
+// CacheListMutex must be held.
+func cachedBytes(id, off, n uint64) uint64 {
+	if NodesChunks[id] == nil || n == 0 {
+		return 0
+	}
+	var res uint64 = 0
+	for c := off / CACHE_CHUNK_SIZE; c * CACHE_CHUNK_SIZE < off + n && c < uint64(len(NodesChunks[id])); c++ {
+		if NodesChunks[id][c] != CHUNK_PRESENT {
+			continue
+		}
+		l := c * CACHE_CHUNK_SIZE
+		r := l + CACHE_CHUNK_SIZE
+		if l < off {
+			l = off
+		}
+		if r > off + n {
+			r = off + n
+		}
+		res += r - l
+	}
+	return res
+}
@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+const FALLOC_FL_KEEP_SIZE = 0x01
+const FALLOC_FL_PUNCH_HOLE = 0x02
+
+// punchHole gives the disk space of a range of a cache file back to the
+// system, the file keeps its size and reads as zeros there.
+func punchHole(f *os.File, off, n uint64) error {
+	return syscall.Fallocate(int(f.Fd()), FALLOC_FL_KEEP_SIZE | FALLOC_FL_PUNCH_HOLE, int64(off), int64(n))
+}
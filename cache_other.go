@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+)
+
+// punchHole can't free part of a file here, the space of evicted chunks is
+// only given back once the whole cache file is removed.
+func punchHole(f *os.File, off, n uint64) error {
+	return nil
+}
@@ -0,0 +1,146 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"io"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+// Packed blocks may be compressed with zstd, in independent segments of
+// COMPRESS_SEGMENT_SIZE bytes so that ranges can still be read. The stored
+// sizes of the segments are kept in the node, a segment whose stored size is
+// its plain size was kept raw.
+const COMPRESS_SEGMENT_SIZE uint64 = 1048576
+// blocks that don't shrink by at least 1/COMPRESS_MIN_GAIN are stored raw
+const COMPRESS_MIN_GAIN uint64 = 16
+
+const NODE_COMPRESSED uint64 = 2
+
+var zstdEncoder, _ = zstd.NewWriter(nil)
+var zstdDecoder, _ = zstd.NewReader(nil)
+
+// compressBlock returns what to store for the block buf and the sizes of its
+// segments, or buf itself and nil if it isn't worth compressing.
+func compressBlock(buf []byte) ([]byte, []uint64) {
+	res := make([]byte, 0, len(buf))
+	segs := make([]uint64, 0)
+	for l := uint64(0); l < uint64(len(buf)); l += COMPRESS_SEGMENT_SIZE {
+		r := l + COMPRESS_SEGMENT_SIZE
+		if r > uint64(len(buf)) {
+			r = uint64(len(buf))
+		}
+		t := zstdEncoder.EncodeAll(buf[l: r], nil)
+		if uint64(len(t)) >= r - l {
+			t = buf[l: r]
+		}
+		res = append(res, t...)
+		segs = append(segs, uint64(len(t)))
+	}
+	if uint64(len(res)) > uint64(len(buf)) - uint64(len(buf)) / COMPRESS_MIN_GAIN {
+		return buf, nil
+	}
+	return res, segs
+}
+
+// storedSize is the size of node before encryption.
+func storedSize(node Node) uint64 {
+	if node.Flags & NODE_COMPRESSED == 0 {
+		return node.Size
+	}
+	var res uint64 = 0
+	for _, t := range node.Segments {
+		res += t
+	}
+	return res
+}
+
+// readBlock downloads the plain bytes [off, off + n) of node id.
+func readBlock(id uint64, node Node, off, n uint64, prio int) ([]byte, error) {
+	if node.Flags & NODE_COMPRESSED == 0 {
+		return readStored(id, node, off, n, prio)
+	}
+	a := off / COMPRESS_SEGMENT_SIZE
+	b := (off + n - 1) / COMPRESS_SEGMENT_SIZE + 1
+	if off + n > node.Size || b > uint64(len(node.Segments)) {
+		return nil, errors.New("read past the end of a compressed block")
+	}
+	var l uint64 = 0
+	for i := uint64(0); i < a; i++ {
+		l += node.Segments[i]
+	}
+	r := l
+	for i := a; i < b; i++ {
+		r += node.Segments[i]
+	}
+	buf, err := readStored(id, node, l, r - l, prio)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]byte, 0, (b - a) * COMPRESS_SEGMENT_SIZE)
+	var pos uint64 = 0
+	for i := a; i < b; i++ {
+		t := buf[pos: pos + node.Segments[i]]
+		pos += node.Segments[i]
+		p, err := decompressSegment(node, i, t)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, p...)
+	}
+	l = off - a * COMPRESS_SEGMENT_SIZE
+	return res[l: l + n], nil
+}
+
+// decompressSegment returns the plain bytes of segment i of node, stored as
+// t.
+func decompressSegment(node Node, i uint64, t []byte) ([]byte, error) {
+	raw := node.Size - i * COMPRESS_SEGMENT_SIZE
+	if raw > COMPRESS_SEGMENT_SIZE {
+		raw = COMPRESS_SEGMENT_SIZE
+	}
+	if uint64(len(t)) == raw {
+		return t, nil
+	}
+	p, err := zstdDecoder.DecodeAll(t, nil)
+	if err != nil {
+		return nil, err
+	}
+	if uint64(len(p)) != raw {
+		return nil, errors.New("bad size of decompressed segment")
+	}
+	return p, nil
+}
+
+// blockHash returns the SHA-256 of the plain block of node, whose stored
+// form (compressed and encrypted, as uploaded) is read from r a segment at a
+// time.
+func blockHash(node Node, r io.Reader) ([sha256.Size]byte, error) {
+	var res [sha256.Size]byte
+	if node.Flags & NODE_ENCRYPTED != 0 {
+		r = &decryptReader{r: r, salt: node.Salt}
+	}
+	h := sha256.New()
+	if node.Flags & NODE_COMPRESSED == 0 {
+		_, err := io.CopyN(h, r, int64(node.Size))
+		if err != nil {
+			return res, err
+		}
+	} else {
+		for i, n := range node.Segments {
+			t := make([]byte, n)
+			_, err := io.ReadFull(r, t)
+			if err != nil {
+				return res, err
+			}
+			p, err := decompressSegment(node, uint64(i), t)
+			if err != nil {
+				return res, err
+			}
+			h.Write(p)
+		}
+	}
+	copy(res[:], h.Sum(nil))
+	return res, nil
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io/ioutil"
+	"math/rand"
+	"strconv"
+	"strings"
+	"testing"
+
+	"./backend"
+)
+
+// testBlock returns a block of which some segments compress, and the third
+// one doesn't.
+func testBlock() []byte {
+	res := []byte(strings.Repeat("00:01:02,000 --> 00:01:04,000\n", 70000))[:2 * COMPRESS_SEGMENT_SIZE]
+	t := make([]byte, 3 * COMPRESS_SEGMENT_SIZE / 2)
+	rand.Read(t)
+	res = append(res, t...)
+	return append(res, strings.Repeat("nfo", 300000)...)
+}
+
+func TestCompressBlock(t *testing.T) {
+	data := testBlock()
+	stored, segs := compressBlock(data)
+	if segs == nil {
+		t.Fatal("not compressed")
+	}
+	node := Node{Size: uint64(len(data)), Flags: NODE_COMPRESSED, Segments: segs}
+	if uint64(len(segs)) != (node.Size + COMPRESS_SEGMENT_SIZE - 1) / COMPRESS_SEGMENT_SIZE || storedSize(node) != uint64(len(stored)) {
+		t.Fatal("segments", segs)
+	}
+	var pos uint64 = 0
+	raw := 0
+	for i, n := range segs {
+		l := uint64(i) * COMPRESS_SEGMENT_SIZE
+		r := l + COMPRESS_SEGMENT_SIZE
+		if r > node.Size {
+			r = node.Size
+		}
+		p := stored[pos: pos + n]
+		if n == r - l {
+			raw++
+		} else {
+			var err error
+			p, err = zstdDecoder.DecodeAll(p, nil)
+			if err != nil {
+				t.Fatal(i, err)
+			}
+		}
+		if !bytes.Equal(p, data[l: r]) {
+			t.Fatal("segment", i)
+		}
+		pos += n
+	}
+	if raw == 0 {
+		t.Fatal("random segments compressed")
+	}
+	t2 := make([]byte, 3000000)
+	rand.Read(t2)
+	if _, segs := compressBlock(t2); segs != nil {
+		t.Fatal("random block compressed")
+	}
+}
+
+// Ranges of compressed blocks are read back from the backend, encrypted or
+// not.
+func TestReadCompressed(t *testing.T) {
+	for _, key := range []bool{false, true} {
+		func() {
+			defer testFS(t, "local")()
+			if key {
+				ioutil.WriteFile(KEY_FILE, []byte("pw\n"), 0600)
+			}
+			data := testBlock()
+			stored, segs := compressBlock(data)
+			i := appendNode(Node{Size: uint64(len(data)), Flags: newNodeFlags() | NODE_COMPRESSED, Segments: segs, Hash: sha256.Sum256(data)})
+			ioutil.WriteFile(TMP_PATH + strconv.FormatUint(i, 10), stored, 0644)
+			startUpload(i)
+			waitUploads()
+			if key != (Nodes[i].Flags & NODE_ENCRYPTED != 0) {
+				t.Fatal("flags", Nodes[i].Flags)
+			}
+			for _, r := range [][2]uint64{{0, 10}, {1048570, 20}, {3000000, 145000}, {0, uint64(len(data))}} {
+				b, err := readBlock(i, Nodes[i], r[0], r[1], backend.PRIO_READ)
+				if err != nil {
+					t.Fatal(r, err)
+				}
+				if !bytes.Equal(b, data[r[0]: r[0] + r[1]]) {
+					t.Fatal("range", r)
+				}
+			}
+			if _, err := readBlock(i, Nodes[i], uint64(len(data)) - 5, 10, backend.PRIO_READ); err == nil {
+				t.Fatal("read past the end")
+			}
+		}()
+	}
+}
+
+func TestBlockHash(t *testing.T) {
+	defer testFS(t, "local")()
+	ioutil.WriteFile(KEY_FILE, []byte("pw\n"), 0600)
+	data := testBlock()
+	want := sha256.Sum256(data)
+	for _, fl := range []uint64{0, NODE_COMPRESSED, NODE_ENCRYPTED, NODE_COMPRESSED | NODE_ENCRYPTED} {
+		node := Node{Size: uint64(len(data)), Flags: fl, Salt: newNodeSalt()}
+		stored := data
+		if fl & NODE_COMPRESSED != 0 {
+			stored, node.Segments = compressBlock(data)
+		}
+		if fl & NODE_ENCRYPTED != 0 {
+			ioutil.WriteFile("plain", stored, 0644)
+			err := encryptFile("plain", "sealed", node.Salt)
+			if err != nil {
+				t.Fatal(err)
+			}
+			stored, _ = ioutil.ReadFile("sealed")
+		}
+		h, err := blockHash(node, bytes.NewReader(stored))
+		if err != nil || h != want {
+			t.Fatal(fl, err)
+		}
+		bad := append([]byte{}, stored...)
+		bad[len(bad) / 2] ^= 1
+		h, err = blockHash(node, bytes.NewReader(bad))
+		if err == nil && h == want {
+			t.Fatal("damage not seen", fl)
+		}
+		h, err = blockHash(node, bytes.NewReader(stored[:len(stored) - 1]))
+		if err == nil && h == want {
+			t.Fatal("truncation not seen", fl)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// Encrypted blocks are cut in segments of CRYPT_SEGMENT_SIZE bytes, each one
+// stored as a random nonce followed by the AES-256-GCM sealed segment, so
+// that any range can be decrypted on its own. The salt of the block and the
+// number of the segment are authenticated along, so segments can't be moved
+// within a block or to another one.
+const CRYPT_SEGMENT_SIZE uint64 = 65536
+const CRYPT_OVERHEAD uint64 = 12 + 16
+
+const NODE_ENCRYPTED uint64 = 1
+
+// CryptSalt is the scrypt salt of the library, saved in fs_data.
+var CryptSalt [16]byte
+
+var cryptAEAD cipher.AEAD
+var cryptKeySalt [16]byte
+var cryptLoaded bool
+var cryptMutex sync.Mutex
+
+var errNoKey = errors.New("block is encrypted but " + KEY_FILE + " is missing")
+
+// getAEAD returns the cipher derived from the passphrase in KEY_FILE, or
+// nil when there is no such file. A salt is made up if the library has none.
+func getAEAD() cipher.AEAD {
+	FSMutex.Lock()
+	if CryptSalt == [16]byte{} {
+		if _, err := os.Stat(KEY_FILE); err == nil {
+			rand.Read(CryptSalt[:])
+			journalSalt()
+		}
+	}
+	salt := CryptSalt
+	FSMutex.Unlock()
+	cryptMutex.Lock()
+	defer cryptMutex.Unlock()
+	if cryptLoaded && cryptKeySalt == salt {
+		return cryptAEAD
+	}
+	cryptLoaded = true
+	cryptKeySalt = salt
+	cryptAEAD = deriveAEAD(salt)
+	return cryptAEAD
+}
+
+// deriveAEAD derives the cipher of the passphrase in KEY_FILE with salt, nil
+// when there is no such file.
+func deriveAEAD(salt [16]byte) cipher.AEAD {
+	t, err := ioutil.ReadFile(KEY_FILE)
+	if err != nil {
+		return nil
+	}
+	pass := strings.TrimRight(string(t), "\r\n")
+	key, err := scrypt.Key([]byte(pass), salt[:], 32768, 8, 1, 32)
+	if err != nil {
+		log.Fatal(err)
+	}
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		log.Fatal(err)
+	}
+	res, err := cipher.NewGCM(c)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return res
+}
+
+// newNodeFlags returns the flags of blocks made now.
+func newNodeFlags() uint64 {
+	if getAEAD() != nil {
+		return NODE_ENCRYPTED
+	}
+	return 0
+}
+
+// newNodeSalt returns the salt of an encrypted block made now.
+func newNodeSalt() [8]byte {
+	var res [8]byte
+	// all zeros is for blocks without salt
+	for res == [8]byte{} {
+		rand.Read(res[:])
+	}
+	return res
+}
+
+// segmentAD is what segment i of a block with salt is authenticated with.
+// Blocks encrypted before they had a salt only have the number.
+func segmentAD(salt [8]byte, i uint64) []byte {
+	if salt == [8]byte{} {
+		res := make([]byte, 8)
+		binary.BigEndian.PutUint64(res, i)
+		return res
+	}
+	res := make([]byte, 16)
+	copy(res, salt[:])
+	binary.BigEndian.PutUint64(res[8:], i)
+	return res
+}
+
+func cryptStoredSize(size uint64) uint64 {
+	return size + (size + CRYPT_SEGMENT_SIZE - 1) / CRYPT_SEGMENT_SIZE * CRYPT_OVERHEAD
+}
+
+func encryptFile(src, dst string, salt [8]byte) error {
+	aead := getAEAD()
+	if aead == nil {
+		return errNoKey
+	}
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	w, err := os.Create(dst)
+	if err != nil {
+		return err
+	}
+	defer w.Close()
+	buf := make([]byte, CRYPT_SEGMENT_SIZE)
+	for i := uint64(0); true; i++ {
+		n, err := io.ReadFull(r, buf)
+		if err == io.EOF {
+			break
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return err
+		}
+		nonce := make([]byte, aead.NonceSize())
+		rand.Read(nonce)
+		_, err = w.Write(aead.Seal(nonce, nonce, buf[:n], segmentAD(salt, i)))
+		if err != nil {
+			return err
+		}
+		if uint64(n) < CRYPT_SEGMENT_SIZE {
+			break
+		}
+	}
+	return w.Sync()
+}
+
+// decryptRange turns stored, the encrypted segments from the one holding
+// off on of a block with salt, back into the n plain bytes at off.
+func decryptRange(salt [8]byte, stored []byte, off, n uint64) ([]byte, error) {
+	aead := getAEAD()
+	if aead == nil {
+		return nil, errNoKey
+	}
+	ss := CRYPT_SEGMENT_SIZE + CRYPT_OVERHEAD
+	a := off / CRYPT_SEGMENT_SIZE
+	res := make([]byte, 0, uint64(len(stored)))
+	for i := uint64(0); i * ss < uint64(len(stored)); i++ {
+		e := (i + 1) * ss
+		if e > uint64(len(stored)) {
+			e = uint64(len(stored))
+		}
+		t := stored[i * ss: e]
+		if uint64(len(t)) < uint64(aead.NonceSize()) {
+			return nil, errors.New("truncated encrypted segment")
+		}
+		p, err := aead.Open(nil, t[:aead.NonceSize()], t[aead.NonceSize():], segmentAD(salt, a + i))
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, p...)
+	}
+	l := off - a * CRYPT_SEGMENT_SIZE
+	if l + n > uint64(len(res)) {
+		return nil, errors.New("truncated encrypted block")
+	}
+	return res[l: l + n], nil
+}
+
+// decryptReader decrypts an encrypted block read from r, a segment at a
+// time.
+type decryptReader struct {
+	r io.Reader
+	salt [8]byte
+	i uint64
+	buf []byte
+}
+
+func (d *decryptReader) Read(p []byte) (int, error) {
+	for len(d.buf) == 0 {
+		t := make([]byte, CRYPT_SEGMENT_SIZE + CRYPT_OVERHEAD)
+		n, err := io.ReadFull(d.r, t)
+		if err == io.EOF {
+			return 0, io.EOF
+		}
+		if err != nil && err != io.ErrUnexpectedEOF {
+			return 0, err
+		}
+		if uint64(n) < CRYPT_OVERHEAD {
+			return 0, errors.New("truncated encrypted segment")
+		}
+		d.buf, err = decryptRange(d.salt, t[:n], d.i * CRYPT_SEGMENT_SIZE, uint64(n) - CRYPT_OVERHEAD)
+		if err != nil {
+			return 0, err
+		}
+		d.i++
+	}
+	n := copy(p, d.buf)
+	d.buf = d.buf[n:]
+	return n, nil
+}
+
+// encryptedRange returns the range of the stored block holding the plain
+// bytes [off, off + n) of a block of size bytes.
+func encryptedRange(size, off, n uint64) (uint64, uint64) {
+	ss := CRYPT_SEGMENT_SIZE + CRYPT_OVERHEAD
+	l := off / CRYPT_SEGMENT_SIZE * ss
+	r := ((off + n - 1) / CRYPT_SEGMENT_SIZE + 1) * ss
+	if r > cryptStoredSize(size) {
+		r = cryptStoredSize(size)
+	}
+	return l, r - l
+}
+
+// readStored downloads the bytes [off, off + n) of node id as they were
+// before encryption, that is still compressed for compressed nodes.
+func readStored(id uint64, node Node, off, n uint64, prio int) ([]byte, error) {
+	if !uploaded(node) {
+		return readTmp(id, off, n)
+	}
+	if node.Flags & NODE_ENCRYPTED == 0 {
+		return readRemote(node, off, n, prio)
+	}
+	l, ln := encryptedRange(storedSize(node), off, n)
+	buf, err := readRemote(node, l, ln, prio)
+	if err != nil {
+		return nil, err
+	}
+	return decryptRange(node.Salt, buf, off, n)
+}
+
+// readTmp reads from the tmp file of node id, which is not encrypted yet.
+func readTmp(id, off, n uint64) ([]byte, error) {
+	f, err := os.Open(TMP_PATH + strconv.FormatUint(id, 10))
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	buf := make([]byte, n)
+	_, err = f.ReadAt(buf, int64(off))
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
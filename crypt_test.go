@@ -0,0 +1,130 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"testing"
+
+	"./backend"
+)
+
+func TestDecryptRange(t *testing.T) {
+	defer testFS(t, "local")()
+	ioutil.WriteFile(KEY_FILE, []byte("hunter2\n"), 0600)
+	data := make([]byte, 3 * CRYPT_SEGMENT_SIZE + 777)
+	rand.Read(data)
+	ioutil.WriteFile("plain", data, 0644)
+	salt := newNodeSalt()
+	err := encryptFile("plain", "sealed", salt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	stored, _ := ioutil.ReadFile("sealed")
+	size := uint64(len(data))
+	if uint64(len(stored)) != cryptStoredSize(size) {
+		t.Fatal("stored size", len(stored))
+	}
+	decrypt := func(salt [8]byte, stored []byte, off, n uint64) ([]byte, error) {
+		l, ln := encryptedRange(size, off, n)
+		return decryptRange(salt, stored[l: l + ln], off, n)
+	}
+	for _, r := range [][2]uint64{{0, 10}, {65530, 30}, {CRYPT_SEGMENT_SIZE, CRYPT_SEGMENT_SIZE}, {size - 10, 10}, {0, size}} {
+		b, err := decrypt(salt, stored, r[0], r[1])
+		if err != nil {
+			t.Fatal(r, err)
+		}
+		if !bytes.Equal(b, data[r[0]: r[0] + r[1]]) {
+			t.Fatal("range", r)
+		}
+	}
+
+	// damaged, moved segments and another salt are refused
+	bad := append([]byte{}, stored...)
+	bad[100] ^= 1
+	if _, err := decrypt(salt, bad, 0, 10); err == nil {
+		t.Fatal("damage not seen")
+	}
+	ss := CRYPT_SEGMENT_SIZE + CRYPT_OVERHEAD
+	bad = append([]byte{}, stored...)
+	copy(bad, stored[ss: 2 * ss])
+	copy(bad[ss:], stored[:ss])
+	if _, err := decrypt(salt, bad, 0, 10); err == nil {
+		t.Fatal("swapped segments")
+	}
+	other := salt
+	other[0] ^= 1
+	if _, err := decrypt(other, stored, 0, 10); err == nil {
+		t.Fatal("other salt")
+	}
+	if _, err := decryptRange(salt, stored[:100], 0, 200); err == nil {
+		t.Fatal("truncated")
+	}
+
+	// blocks encrypted before they had a salt are still read
+	encryptFile("plain", "old", [8]byte{})
+	stored2, _ := ioutil.ReadFile("old")
+	if b, err := decrypt([8]byte{}, stored2, 10, 20); err != nil || !bytes.Equal(b, data[10:30]) {
+		t.Fatal("block without salt", err)
+	}
+	if _, err := decrypt(salt, stored2, 10, 20); err == nil {
+		t.Fatal("block without salt read with one")
+	}
+
+	// a wrong passphrase gives another key
+	ioutil.WriteFile(KEY_FILE, []byte("wrong\n"), 0600)
+	cryptLoaded = false
+	if _, err := decrypt(salt, stored, 0, 10); err == nil {
+		t.Fatal("wrong passphrase")
+	}
+}
+
+// Encrypted blocks are uploaded as such, and read back through a file.
+func TestReadEncrypted(t *testing.T) {
+	defer testFS(t, "local")()
+	ioutil.WriteFile(KEY_FILE, []byte("hunter2\n"), 0600)
+	data := make([]byte, 3 * 1048576 + 777)
+	rand.Read(data)
+	writeTree(t, "src", map[string][]byte{"x": data})
+	copyPath("src", "/dst")
+	waitUploads()
+	n := fileNodes(fileId("/dst/x"))[0]
+	if Nodes[n].Flags & NODE_ENCRYPTED == 0 || Nodes[n].Salt == [8]byte{} {
+		t.Fatal("not encrypted", Nodes[n])
+	}
+	st, err := Remote.Stat(mainSource(Nodes[n]))
+	if err != nil || st.Size != cryptStoredSize(storedSize(Nodes[n])) {
+		t.Fatal(st, err)
+	}
+	salt := Nodes[n].Salt
+	reload()
+	if Nodes[n].Salt != salt {
+		t.Fatal("salt lost by the journal")
+	}
+	mustLockWriter()
+	save()
+	reload()
+	if Nodes[n].Salt != salt {
+		t.Fatal("salt lost by fs_data")
+	}
+	if !bytes.Equal(readFile(t, "/dst/x"), data) {
+		t.Fatal("content")
+	}
+	emptyCache()
+	h := newFileHandle(fileId("/dst/x"))
+	defer h.close()
+	for _, r := range [][2]uint64{{0, 10}, {65530, 65560}, {1048570, 1048590}, {3000000, 3145000}} {
+		b, err := h.readBytes(r[0], r[1])
+		if err != nil {
+			t.Fatal(r, err)
+		}
+		if !bytes.Equal(b, data[r[0]: r[1]]) {
+			t.Fatal("range", r)
+		}
+	}
+	ioutil.WriteFile(KEY_FILE, []byte("wrong\n"), 0600)
+	cryptLoaded = false
+	if _, err := readBlock(n, Nodes[n], 0, 10, backend.PRIO_READ); err == nil {
+		t.Fatal("wrong passphrase")
+	}
+}
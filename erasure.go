@@ -0,0 +1,475 @@
+package main
+
+import (
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+
+	"./backend"
+
+	"github.com/klauspost/reedsolomon"
+)
+
+// With -ec K+M, the stored form of a new block (compressed and encrypted,
+// as it would be uploaded) is cut into K data shards of the same size, the
+// last one padded with zeros, and M parity shards are computed from them
+// with Reed-Solomon. The shards go to different accounts or backends, so any
+// K of them are enough to read the block. Shard j of node i is named
+// "i.j.K.M". Ranges are read from the data shards they fall in, and rebuilt
+// from the same range of K other shards when one can't be read.
+var ECData, ECParity int
+
+func parseEC(s string) {
+	if s == "" {
+		return
+	}
+	t := strings.Split(s, "+")
+	if len(t) == 2 {
+		k, err1 := strconv.Atoi(t[0])
+		m, err2 := strconv.Atoi(t[1])
+		if err1 == nil && err2 == nil && k > 0 && m >= 0 && k + m <= 256 {
+			ECData, ECParity = k, m
+			return
+		}
+	}
+	log.Fatal("bad -ec ", s, ", it should be like 4+2")
+}
+
+// checkEC refuses -ec when there are fewer accounts or backends than shards,
+// as losing one would then lose several shards of a block.
+func checkEC() {
+	if ECData > 0 && backend.Spread(Remote) < ECData + ECParity {
+		log.Fatal("-ec ", ECData, "+", ECParity, " needs ", ECData + ECParity, " accounts or backends, there are ", backend.Spread(Remote))
+	}
+}
+
+func shardName(i uint64, j, k, m int) string {
+	return fmt.Sprintf("%d.%d.%d.%d", i, j, k, m)
+}
+
+// shardSize is the size of each shard of node.
+func shardSize(node Node) uint64 {
+	return (remoteSize(node) + node.DataShards - 1) / node.DataShards
+}
+
+// makeShards cuts src, of size bytes, in k data shards and adds m parity
+// shards, written to files.
+func makeShards(src string, size int64, files []string, k, m int) error {
+	enc, err := reedsolomon.NewStream(k, m)
+	if err != nil {
+		return err
+	}
+	r, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	ws := make([]*os.File, len(files))
+	defer func() {
+		for _, w := range ws {
+			if w != nil {
+				w.Close()
+			}
+		}
+	}()
+	for j := range files {
+		ws[j], err = os.Create(files[j])
+		if err != nil {
+			return err
+		}
+	}
+	data := make([]io.Writer, k)
+	for j := 0; j < k; j++ {
+		data[j] = ws[j]
+	}
+	err = enc.Split(r, data, size)
+	if err != nil {
+		return err
+	}
+	readers := make([]io.Reader, k)
+	for j := 0; j < k; j++ {
+		_, err = ws[j].Seek(0, io.SeekStart)
+		if err != nil {
+			return err
+		}
+		readers[j] = ws[j]
+	}
+	parity := make([]io.Writer, m)
+	for j := 0; j < m; j++ {
+		parity[j] = ws[k + j]
+	}
+	return enc.Encode(readers, parity)
+}
+
+// uploadShards uploads src, the stored form of node i, as shards, retrying
+// until at least ECData of them are up. It returns nil for empty blocks.
+func uploadShards(i uint64, src string) (uint64, []string) {
+	st, err := os.Stat(src)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if st.Size() == 0 {
+		return 0, nil
+	}
+	k, m := ECData, ECParity
+	files := make([]string, k + m)
+	names := make([]string, k + m)
+	for j := range files {
+		files[j] = TMP_PATH + strconv.FormatUint(i, 10) + ".s" + strconv.Itoa(j)
+		names[j] = shardName(i, j, k, m)
+	}
+	defer func() {
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}()
+	err = makeShards(src, st.Size(), files, k, m)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for true {
+		res := backend.UploadSpread(Remote, files, names)
+		c := 0
+		for _, t := range res {
+			if t != "" {
+				c++
+			}
+		}
+		if c >= k {
+			if c < k + m {
+				log.Print("only ", c, " of ", k + m, " shards of node ", i, " could be uploaded, run repair later")
+			}
+			return uint64(k), res
+		}
+		log.Print("only ", c, " of ", k + m, " shards of node ", i, " could be uploaded, retrying")
+		for _, t := range res {
+			if t != "" {
+				Remote.Delete(t)
+			}
+		}
+		time.Sleep(1 * time.Second)
+	}
+	return 0, nil
+}
+
+// readShards downloads n bytes at off of the stored block of node.
+func readShards(node Node, off, n uint64, prio int) ([]byte, error) {
+	ss := shardSize(node)
+	res := make([]byte, 0, n)
+	for n > 0 {
+		j := off / ss
+		x := off % ss
+		l := ss - x
+		if l > n {
+			l = n
+		}
+		b, err := readShardRange(node, j, x, l, prio)
+		if err != nil {
+			return nil, err
+		}
+		res = append(res, b...)
+		off += l
+		n -= l
+	}
+	return res, nil
+}
+
+// readShardRange reads l bytes at x of data shard j, or rebuilds them from
+// the same range of other shards.
+func readShardRange(node Node, j, x, l uint64, prio int) ([]byte, error) {
+	if src := node.Shards[j]; src != "" && !sourceBad(src) {
+		b, err := backend.ReadRange(Remote, src, x, l, prio)
+		if err == nil {
+			return b, nil
+		}
+		sourceFailed(src, err)
+	}
+	k := int(node.DataShards)
+	enc, err := reedsolomon.New(k, len(node.Shards) - k)
+	if err != nil {
+		return nil, err
+	}
+	shards := make([][]byte, len(node.Shards))
+	got := 0
+	for _, i := range shardOrder(node) {
+		if got == k {
+			break
+		}
+		if uint64(i) == j {
+			continue
+		}
+		b, err := backend.ReadRange(Remote, node.Shards[i], x, l, prio)
+		if err != nil {
+			sourceFailed(node.Shards[i], err)
+			continue
+		}
+		shards[i] = b
+		got++
+	}
+	if got < k {
+		return nil, fmt.Errorf("only %d shards of %d could be read", got, k)
+	}
+	err = enc.ReconstructData(shards)
+	if err != nil {
+		return nil, err
+	}
+	return shards[j], nil
+}
+
+// shardOrder returns the indices of the shards of node which exist, the
+// ones which failed lately last.
+func shardOrder(node Node) []int {
+	res := make([]int, 0, len(node.Shards))
+	late := make([]int, 0)
+	for i, src := range node.Shards {
+		if src == "" {
+			continue
+		}
+		if sourceBad(src) {
+			late = append(late, i)
+		} else {
+			res = append(res, i)
+		}
+	}
+	return append(res, late...)
+}
+
+// repairShards downloads enough shards of node i to make again the missing
+// ones, checks the block they make against its hash, and uploads them.
+func repairShards(i uint64, node Node, missing map[int]bool) {
+	k := int(node.DataShards)
+	m := len(node.Shards) - k
+	enc, err := reedsolomon.NewStream(k, m)
+	if err != nil {
+		log.Fatal(err)
+	}
+	base := TMP_PATH + "r" + strconv.FormatUint(i, 10) + ".s"
+	valid := make([]io.Reader, k + m)
+	got := 0
+	for j, src := range node.Shards {
+		if got == k || missing[j] {
+			continue
+		}
+		f, err := os.Create(base + strconv.Itoa(j))
+		if err == nil {
+			err = backend.Download(Remote, src, f, backend.PRIO_PREFETCH)
+			f.Close()
+		}
+		if err != nil {
+			log.Print("download of shard ", j, " of node ", i, " failed: ", err)
+			os.Remove(base + strconv.Itoa(j))
+			continue
+		}
+		got++
+	}
+	defer func() {
+		for j := range node.Shards {
+			os.Remove(base + strconv.Itoa(j))
+		}
+	}()
+	if got < k {
+		fmt.Println("node", i, "can't be repaired,", got, "shards could be read")
+		return
+	}
+	fill := make([]io.Writer, k + m)
+	files := make([]string, 0)
+	names := make([]string, 0)
+	ids := make([]int, 0)
+	opened := make([]*os.File, 0)
+	for j := range node.Shards {
+		f, err := os.OpenFile(base + strconv.Itoa(j), os.O_RDWR | os.O_CREATE, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		opened = append(opened, f)
+		if missing[j] {
+			fill[j] = f
+			files = append(files, base + strconv.Itoa(j))
+			names = append(names, shardName(i, j, k, m))
+			ids = append(ids, j)
+		} else if st, _ := f.Stat(); st.Size() > 0 {
+			valid[j] = f
+		} else if j < k {
+			// the data shards are all needed to check the block
+			fill[j] = f
+		}
+	}
+	err = enc.Reconstruct(valid, fill)
+	for _, f := range opened {
+		f.Close()
+	}
+	if err == nil {
+		err = checkShards(node, base)
+	}
+	if err != nil {
+		fmt.Println("node", i, "can't be repaired:", err)
+		return
+	}
+	res := backend.UploadSpread(Remote, files, names)
+	c := 0
+	FSMutex.Lock()
+	for n, j := range ids {
+		if res[n] != "" {
+			Nodes[i].Shards[j] = res[n]
+			c++
+		}
+	}
+	journalNode(i)
+	FSMutex.Unlock()
+	fmt.Println("node", i, ":", c, "of", len(ids), "shards made again")
+}
+
+// checkShards checks the block made of the data shards of node in the files
+// base0, base1... against its hash.
+func checkShards(node Node, base string) error {
+	if node.Hash == [sha256.Size]byte{} {
+		return nil
+	}
+	rs := make([]io.Reader, node.DataShards)
+	for j := range rs {
+		f, err := os.Open(base + strconv.Itoa(j))
+		if err != nil {
+			return err
+		}
+		defer f.Close()
+		rs[j] = f
+	}
+	hash, err := blockHash(node, io.LimitReader(io.MultiReader(rs...), int64(remoteSize(node))))
+	if err != nil {
+		return err
+	}
+	if hash != node.Hash {
+		return errors.New("the shards read don't make the block, one of them is bad")
+	}
+	return nil
+}
+
+// checkCopy checks the copy of node in the file path against its hash.
+func checkCopy(node Node, path string) error {
+	if node.Hash == [sha256.Size]byte{} {
+		return nil
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	hash, err := blockHash(node, io.LimitReader(f, int64(remoteSize(node))))
+	if err != nil {
+		return err
+	}
+	if hash != node.Hash {
+		return errors.New("content doesn't match")
+	}
+	return nil
+}
+
+// repairCopies uploads copies of node i from one that is left, until it
+// has want of them, instead of the missing ones.
+func repairCopies(i uint64, node Node, missing map[int]bool, want int) {
+	tmp := TMP_PATH + "r" + strconv.FormatUint(i, 10)
+	defer os.Remove(tmp)
+	// the missing ones are only dropped when there are enough left
+	ok := len(node.Sources) - len(missing) >= want
+	left := make([]string, 0)
+	for j, src := range node.Sources {
+		if missing[j] {
+			continue
+		}
+		left = append(left, src)
+		if ok {
+			continue
+		}
+		f, err := os.Create(tmp)
+		if err == nil {
+			err = backend.Download(Remote, src, f, backend.PRIO_PREFETCH)
+			f.Close()
+		}
+		if err != nil {
+			log.Print("download of ", src, " failed: ", err)
+			continue
+		}
+		// a bad copy is dropped like a missing one
+		if err = checkCopy(node, tmp); err != nil {
+			fmt.Println("node", i, src, ":", err)
+			left = left[:len(left) - 1]
+			continue
+		}
+		ok = true
+	}
+	if !ok {
+		fmt.Println("node", i, "can't be repaired, no copy could be read")
+		return
+	}
+	t := make([]string, 0)
+	if want > len(left) {
+		t = backend.UploadReplicas(Remote, tmp, strconv.FormatUint(i, 10), want - len(left), left)
+	}
+	FSMutex.Lock()
+	Nodes[i].Sources = append(left, t...)
+	journalNode(i)
+	FSMutex.Unlock()
+	fmt.Println("node", i, ":", len(t), "copies made again")
+}
+
+// repairMain makes again the shards of erasure coded nodes, and the copies
+// of the others, which are missing on the remote, from those left.
+func repairMain() {
+	objs, err := Remote.List()
+	if err != nil {
+		log.Fatal(err)
+	}
+	present := make(map[string]bool)
+	for _, o := range objs {
+		present[o.Source] = true
+	}
+	want := Replicas
+	if want < 1 {
+		want = 1
+	}
+	FSMutex.Lock()
+	used := nodeRefs()
+	nodes := make([]Node, len(Nodes))
+	copy(nodes, Nodes)
+	for i := range nodes {
+		nodes[i].Sources = append([]string(nil), Nodes[i].Sources...)
+		nodes[i].Shards = append([]string(nil), Nodes[i].Shards...)
+	}
+	FSMutex.Unlock()
+	for n, node := range nodes {
+		i := uint64(n)
+		if used[i] == 0 || !uploaded(node) {
+			continue
+		}
+		missing := make(map[int]bool)
+		if len(node.Shards) > 0 {
+			for j, src := range node.Shards {
+				if src == "" || !present[src] {
+					missing[j] = true
+				}
+			}
+			if len(missing) == 0 {
+				continue
+			}
+			fmt.Println("node", i, "misses", len(missing), "shards")
+			repairShards(i, node, missing)
+			continue
+		}
+		for j, src := range node.Sources {
+			if !present[src] {
+				missing[j] = true
+			}
+		}
+		if len(missing) == 0 && len(node.Sources) >= want {
+			continue
+		}
+		fmt.Println("node", i, "has", len(node.Sources) - len(missing), "copies of", want)
+		repairCopies(i, node, missing, want)
+	}
+}
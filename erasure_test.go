@@ -0,0 +1,167 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"strings"
+	"testing"
+	"time"
+
+	"./backend"
+)
+
+// sourcePath returns the file of the local backend holding src.
+func sourcePath(src string) string {
+	if i := strings.Index(src, ":"); i != -1 {
+		src = src[i + 1:]
+	}
+	return backend.LOCAL_PATH + src[:strings.Index(src, "|")]
+}
+
+func TestShards(t *testing.T) {
+	defer testFS(t, "local,local,local")()
+	data := make([]byte, 1001)
+	rand.Read(data)
+	ioutil.WriteFile("block", data, 0644)
+	files := []string{"s0", "s1", "s2"}
+	err := makeShards("block", int64(len(data)), files, 2, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	shards := make([][]byte, len(files))
+	for j := range files {
+		shards[j], _ = ioutil.ReadFile(files[j])
+		if len(shards[j]) != 501 {
+			t.Fatal("shard", j, "has", len(shards[j]), "bytes")
+		}
+	}
+	if !bytes.Equal(append(shards[0], shards[1]...)[:len(data)], data) {
+		t.Fatal("data shards")
+	}
+
+	node := Node{Size: uint64(len(data)), DataShards: 2}
+	node.Shards = backend.UploadSpread(Remote, files, []string{"0.0.2.1", "0.1.2.1", "0.2.2.1"})
+	read := func() {
+		for _, r := range [][2]uint64{{0, 1001}, {0, 10}, {495, 10}, {501, 500}, {1000, 1}} {
+			b, err := readShards(node, r[0], r[1], backend.PRIO_READ)
+			if err != nil {
+				t.Fatal(r, err)
+			}
+			if !bytes.Equal(b, data[r[0]: r[0] + r[1]]) {
+				t.Fatal("range", r)
+			}
+		}
+	}
+	read()
+	// any 2 of the 3 shards are enough
+	os.Remove(sourcePath(node.Shards[0]))
+	read()
+	sourceFailures = make(map[string]time.Time)
+	os.Remove(sourcePath(node.Shards[2]))
+	if _, err := readShards(node, 0, 10, backend.PRIO_READ); err == nil {
+		t.Fatal("read with only one shard")
+	}
+	sourceFailures = make(map[string]time.Time)
+}
+
+// A copy with -ec is read back after losing shards, and repaired, but never
+// from a damaged shard.
+func TestErasureRepair(t *testing.T) {
+	defer testFS(t, "local,local,local")()
+	parseEC("2+1")
+	defer func() { sourceFailures = make(map[string]time.Time) }()
+	data := make([]byte, 100001)
+	rand.Read(data)
+	writeTree(t, "src", map[string][]byte{"x": data})
+	copyPath("src", "/dst")
+	waitUploads()
+	n := fileNodes(fileId("/dst/x"))[0]
+	if Nodes[n].DataShards != 2 || len(Nodes[n].Shards) != 3 || len(Nodes[n].Sources) != 0 {
+		t.Fatal("not stored as shards", Nodes[n])
+	}
+	reload()
+	mustLockWriter()
+	if Nodes[n].DataShards != 2 || len(Nodes[n].Shards) != 3 {
+		t.Fatal("shards lost by the journal", Nodes[n])
+	}
+	check := func() {
+		emptyCache()
+		if !bytes.Equal(readFile(t, "/dst/x"), data) {
+			t.Fatal("content")
+		}
+	}
+	os.Remove(sourcePath(Nodes[n].Shards[0]))
+	check()
+	old := Nodes[n].Shards[0]
+	repairMain()
+	if Nodes[n].Shards[0] == old {
+		t.Fatal("shard not repaired")
+	}
+	sourceFailures = make(map[string]time.Time)
+	os.Remove(sourcePath(Nodes[n].Shards[1]))
+	repairMain()
+	check()
+
+	// a damaged shard is caught before the repair is uploaded
+	sourceFailures = make(map[string]time.Time)
+	p := sourcePath(Nodes[n].Shards[0])
+	b, _ := ioutil.ReadFile(p)
+	b[0] ^= 1
+	ioutil.WriteFile(p, b, 0644)
+	os.Remove(sourcePath(Nodes[n].Shards[2]))
+	old = Nodes[n].Shards[2]
+	repairMain()
+	if Nodes[n].Shards[2] != old && Nodes[n].Shards[2] != "" {
+		t.Fatal("repaired from a damaged shard", Nodes[n].Shards)
+	}
+}
+
+// part returns the backend of a source of multi.
+func part(src string) string {
+	if i := strings.Index(src, ":"); i != -1 {
+		return src[:i]
+	}
+	return "0"
+}
+
+// A lost copy is made again on another backend than the one left, never
+// from a damaged copy.
+func TestCopyRepair(t *testing.T) {
+	defer testFS(t, "local,local,local")()
+	Replicas = 2
+	defer func() { sourceFailures = make(map[string]time.Time) }()
+	data := make([]byte, 10001)
+	rand.Read(data)
+	writeTree(t, "src", map[string][]byte{"x": data})
+	copyPath("src", "/dst")
+	waitUploads()
+	n := fileNodes(fileId("/dst/x"))[0]
+	if len(Nodes[n].Sources) != 2 {
+		t.Fatal("not copied twice", Nodes[n])
+	}
+	os.Remove(sourcePath(Nodes[n].Sources[0]))
+	left := Nodes[n].Sources[1]
+	repairMain()
+	s := Nodes[n].Sources
+	if len(s) != 2 || s[0] != left || part(s[1]) == part(left) {
+		t.Fatal("copy not repaired to another backend", s)
+	}
+	emptyCache()
+	if !bytes.Equal(readFile(t, "/dst/x"), data) {
+		t.Fatal("content")
+	}
+
+	sourceFailures = make(map[string]time.Time)
+	p := sourcePath(Nodes[n].Sources[0])
+	b, _ := ioutil.ReadFile(p)
+	b[0] ^= 1
+	ioutil.WriteFile(p, b, 0644)
+	os.Remove(sourcePath(Nodes[n].Sources[1]))
+	s = append([]string(nil), Nodes[n].Sources...)
+	repairMain()
+	if len(Nodes[n].Sources) != 2 || Nodes[n].Sources[1] != s[1] {
+		t.Fatal("repaired from a damaged copy", Nodes[n].Sources)
+	}
+}
@@ -0,0 +1,583 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"errors"
+	"fmt"
+)
+
+// fs_data starts with FS_DATA_MAGIC and the format version, followed by
+// sections, each one its tag, its length and its content, and ends with the
+// SHA-256 of everything before. Sections after SECTION_META were added later
+// and may be missing, the fs then gets their defaults, and sections this
+// version doesn't know are skipped. Files without the magic are in the layout
+// used before, which is still read and replaced on the next save.
+const FS_DATA_MAGIC = "seeefs\x00\x00"
+const FS_DATA_VERSION = 1
+
+const (
+	SECTION_DIRS = 1
+	SECTION_FILES = 2
+	SECTION_NODES = 3
+	SECTION_META = 4
+	// metadata of dirs and files, and symlink targets
+	SECTION_ATTRS = 5
+	// sources of the nodes after the first one
+	SECTION_REPLICAS = 6
+	// shards of erasure coded nodes
+	SECTION_SHARDS = 7
+	// salts of encrypted nodes
+	SECTION_SALTS = 8
+)
+
+// fsState is what fs_data holds.
+type fsState struct {
+	Dirs []Dir
+	Files []File
+	Nodes []Node
+	Inodes uint64
+	Salt [16]byte
+	Seq uint64
+}
+
+func appendUvarint(s []byte, x uint64) []byte {
+	n := len(s)
+	s = append(s, make([]byte, binary.MaxVarintLen64)...)
+	n += binary.PutUvarint(s[n:], x)
+	return s[:n]
+}
+
+func appendVarint(s []byte, x int64) []byte {
+	n := len(s)
+	s = append(s, make([]byte, binary.MaxVarintLen64)...)
+	n += binary.PutVarint(s[n:], x)
+	return s[:n]
+}
+
+func appendMeta(res []byte, m Meta) []byte {
+	res = appendUvarint(res, uint64(m.Mode))
+	res = appendUvarint(res, uint64(m.Uid))
+	res = appendUvarint(res, uint64(m.Gid))
+	res = appendVarint(res, m.Mtime)
+	return appendVarint(res, m.Ctime)
+}
+
+func appendString(res []byte, s string) []byte {
+	res = appendUvarint(res, uint64(len(s)))
+	return append(res, s...)
+}
+
+func appendStrings(res []byte, s []string) []byte {
+	res = appendUvarint(res, uint64(len(s)))
+	for _, t := range s {
+		res = appendString(res, t)
+	}
+	return res
+}
+
+func appendSection(res []byte, tag uint64, t []byte) []byte {
+	res = appendUvarint(res, tag)
+	res = appendUvarint(res, uint64(len(t)))
+	return append(res, t...)
+}
+
+// decoder reads fields from s, and keeps the first error instead of running
+// past its end.
+type decoder struct {
+	s []byte
+	n int
+	err error
+}
+
+var errTruncated = errors.New("truncated")
+
+func (d *decoder) fail(err error) {
+	if d.err == nil {
+		d.err = err
+	}
+	d.n = len(d.s)
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	a, b := binary.Uvarint(d.s[d.n:])
+	if b <= 0 {
+		d.fail(errTruncated)
+		return 0
+	}
+	d.n += b
+	return a
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	a, b := binary.Varint(d.s[d.n:])
+	if b <= 0 {
+		d.fail(errTruncated)
+		return 0
+	}
+	d.n += b
+	return a
+}
+
+func (d *decoder) meta() Meta {
+	var m Meta
+	m.Mode = uint32(d.uvarint())
+	m.Uid = uint32(d.uvarint())
+	m.Gid = uint32(d.uvarint())
+	m.Mtime = d.varint()
+	m.Ctime = d.varint()
+	return m
+}
+
+func (d *decoder) bytes(n uint64) []byte {
+	if d.err != nil {
+		return nil
+	}
+	if n > uint64(len(d.s) - d.n) {
+		d.fail(errTruncated)
+		return nil
+	}
+	res := d.s[d.n: d.n + int(n)]
+	d.n += int(n)
+	return res
+}
+
+func (d *decoder) string() string {
+	return string(d.bytes(d.uvarint()))
+}
+
+func (d *decoder) strings() []string {
+	res := make([]string, d.count(1))
+	for i := 0; i < len(res); i++ {
+		res[i] = d.string()
+	}
+	return res
+}
+
+// count reads a number of items which take at least min bytes each.
+func (d *decoder) count(min int) uint64 {
+	a := d.uvarint()
+	if a > uint64(len(d.s) - d.n) / uint64(min) {
+		d.fail(errTruncated)
+		return 0
+	}
+	return a
+}
+
+// runes reads a string of the old layout, one uvarint per rune.
+func (d *decoder) runes() string {
+	ts := make([]rune, d.count(1))
+	for j := 0; j < len(ts); j++ {
+		ts[j] = rune(d.uvarint())
+	}
+	return string(ts)
+}
+
+func (d *decoder) ids(min int) []uint64 {
+	res := make([]uint64, d.count(min))
+	for j := 0; j < len(res); j++ {
+		res[j] = d.uvarint()
+	}
+	return res
+}
+
+func (d *decoder) done() bool {
+	return d.n == len(d.s)
+}
+
+func saveBytes() []byte {
+	res := []byte(FS_DATA_MAGIC)
+	res = appendUvarint(res, FS_DATA_VERSION)
+	t := appendUvarint(make([]byte, 0), uint64(len(Dirs)))
+	for i := 0; i < len(Dirs); i++ {
+		t = appendString(t, Dirs[i].Name)
+		t = appendUvarint(t, Dirs[i].Inode)
+		t = appendUvarint(t, uint64(len(Dirs[i].Child)))
+		for _, c := range Dirs[i].Child {
+			t = appendUvarint(t, c)
+		}
+		t = appendUvarint(t, uint64(len(Dirs[i].Files)))
+		for _, c := range Dirs[i].Files {
+			t = appendUvarint(t, c)
+		}
+	}
+	res = appendSection(res, SECTION_DIRS, t)
+	t = appendUvarint(make([]byte, 0), uint64(len(Files)))
+	for i := 0; i < len(Files); i++ {
+		t = appendString(t, Files[i].Name)
+		t = appendUvarint(t, Files[i].Inode)
+		t = appendUvarint(t, Files[i].Size)
+		t = appendUvarint(t, Files[i].Storage.NodeId)
+		t = appendUvarint(t, Files[i].Storage.NodePos)
+		t = append(t, Files[i].SHA512[:]...)
+		t = appendUvarint(t, uint64(len(Files[i].Storage.Nodes)))
+		for _, c := range Files[i].Storage.Nodes {
+			t = appendUvarint(t, c)
+		}
+	}
+	res = appendSection(res, SECTION_FILES, t)
+	t = appendUvarint(make([]byte, 0), uint64(len(Nodes)))
+	for i := 0; i < len(Nodes); i++ {
+		t = appendUvarint(t, Nodes[i].Size)
+		t = appendString(t, mainSource(Nodes[i]))
+		t = append(t, Nodes[i].Hash[:]...)
+		t = appendUvarint(t, Nodes[i].Flags)
+		t = appendUvarint(t, uint64(len(Nodes[i].Segments)))
+		for _, c := range Nodes[i].Segments {
+			t = appendUvarint(t, c)
+		}
+	}
+	res = appendSection(res, SECTION_NODES, t)
+	t = appendUvarint(make([]byte, 0), Inodes)
+	t = append(t, CryptSalt[:]...)
+	t = appendUvarint(t, JournalSeq)
+	res = appendSection(res, SECTION_META, t)
+	t = appendUvarint(make([]byte, 0), uint64(len(Dirs)))
+	for i := 0; i < len(Dirs); i++ {
+		t = appendMeta(t, Dirs[i].Meta)
+	}
+	t = appendUvarint(t, uint64(len(Files)))
+	for i := 0; i < len(Files); i++ {
+		t = appendMeta(t, Files[i].Meta)
+		t = appendString(t, Files[i].Link)
+	}
+	res = appendSection(res, SECTION_ATTRS, t)
+	t = make([]byte, 0)
+	for i := 0; i < len(Nodes); i++ {
+		if len(Nodes[i].Sources) > 1 {
+			t = appendUvarint(t, uint64(i))
+			t = appendStrings(t, replicaSources(Nodes[i]))
+		}
+	}
+	res = appendSection(res, SECTION_REPLICAS, t)
+	t = make([]byte, 0)
+	for i := 0; i < len(Nodes); i++ {
+		if len(Nodes[i].Shards) > 0 {
+			t = appendUvarint(t, uint64(i))
+			t = appendUvarint(t, Nodes[i].DataShards)
+			t = appendStrings(t, Nodes[i].Shards)
+		}
+	}
+	res = appendSection(res, SECTION_SHARDS, t)
+	t = make([]byte, 0)
+	for i := 0; i < len(Nodes); i++ {
+		if Nodes[i].Salt != [8]byte{} {
+			t = appendUvarint(t, uint64(i))
+			t = append(t, Nodes[i].Salt[:]...)
+		}
+	}
+	res = appendSection(res, SECTION_SALTS, t)
+	sum := sha256.Sum256(res)
+	return append(res, sum[:]...)
+}
+
+func decodeDirs(d *decoder, st *fsState) {
+	st.Dirs = make([]Dir, d.count(3))
+	for i := 0; i < len(st.Dirs); i++ {
+		st.Dirs[i].Name = d.string()
+		st.Dirs[i].Inode = d.uvarint()
+		st.Dirs[i].Child = d.ids(1)
+		st.Dirs[i].Files = d.ids(1)
+	}
+}
+
+func decodeFiles(d *decoder, st *fsState) {
+	st.Files = make([]File, d.count(6 + sha512.Size))
+	for i := 0; i < len(st.Files); i++ {
+		f := &st.Files[i]
+		f.Name = d.string()
+		f.Inode = d.uvarint()
+		f.Size = d.uvarint()
+		f.Storage.NodeId = d.uvarint()
+		f.Storage.NodePos = d.uvarint()
+		copy(f.SHA512[:], d.bytes(sha512.Size))
+		f.Storage.Nodes = d.ids(1)
+	}
+}
+
+func decodeNodes(d *decoder, st *fsState) {
+	st.Nodes = make([]Node, d.count(4 + sha256.Size))
+	for i := 0; i < len(st.Nodes); i++ {
+		node := &st.Nodes[i]
+		node.Size = d.uvarint()
+		if src := d.string(); src != "" {
+			node.Sources = []string{src}
+		}
+		copy(node.Hash[:], d.bytes(sha256.Size))
+		node.Flags = d.uvarint()
+		if segs := d.ids(1); len(segs) > 0 {
+			node.Segments = segs
+		}
+	}
+}
+
+func decodeFSData(s []byte) (*fsState, error) {
+	if len(s) < len(FS_DATA_MAGIC) + sha256.Size {
+		return nil, errTruncated
+	}
+	body := s[:len(s) - sha256.Size]
+	if sum := sha256.Sum256(body); !bytes.Equal(sum[:], s[len(body):]) {
+		return nil, errors.New("checksum mismatch")
+	}
+	d := &decoder{s: body, n: len(FS_DATA_MAGIC)}
+	version := d.uvarint()
+	if d.err == nil && version > FS_DATA_VERSION {
+		return nil, fmt.Errorf("version %d is newer than this seeefs (%d)", version, FS_DATA_VERSION)
+	}
+	st := &fsState{}
+	seen := make(map[uint64]bool)
+	var attrs, replicas, shards, salts *decoder
+	for d.err == nil && !d.done() {
+		tag := d.uvarint()
+		t := &decoder{s: d.bytes(d.uvarint())}
+		if d.err != nil {
+			break
+		}
+		seen[tag] = true
+		switch tag {
+		case SECTION_DIRS:
+			decodeDirs(t, st)
+		case SECTION_FILES:
+			decodeFiles(t, st)
+		case SECTION_NODES:
+			decodeNodes(t, st)
+		case SECTION_META:
+			st.Inodes = t.uvarint()
+			copy(st.Salt[:], t.bytes(16))
+			st.Seq = t.uvarint()
+		case SECTION_ATTRS:
+			// read once the dirs and files are
+			attrs = t
+			continue
+		case SECTION_REPLICAS:
+			replicas = t
+			continue
+		case SECTION_SHARDS:
+			shards = t
+			continue
+		case SECTION_SALTS:
+			salts = t
+			continue
+		default:
+			// sections of later versions which this one can do without
+			continue
+		}
+		if t.err == nil && !t.done() {
+			t.err = errors.New("trailing bytes")
+		}
+		if t.err != nil {
+			return nil, fmt.Errorf("section %d: %v", tag, t.err)
+		}
+	}
+	if d.err != nil {
+		return nil, d.err
+	}
+	for _, tag := range []uint64{SECTION_DIRS, SECTION_FILES, SECTION_NODES, SECTION_META} {
+		if !seen[tag] {
+			return nil, fmt.Errorf("section %d missing", tag)
+		}
+	}
+	// files from before it have no metadata
+	if attrs != nil {
+		decodeAttrs(attrs, st)
+		if attrs.err == nil && !attrs.done() {
+			attrs.err = errors.New("trailing bytes")
+		}
+		if attrs.err != nil {
+			return nil, fmt.Errorf("section %d: %v", SECTION_ATTRS, attrs.err)
+		}
+	}
+	if replicas != nil {
+		decodeReplicas(replicas, st)
+		if replicas.err != nil {
+			return nil, fmt.Errorf("section %d: %v", SECTION_REPLICAS, replicas.err)
+		}
+	}
+	if shards != nil {
+		decodeShards(shards, st)
+		if shards.err != nil {
+			return nil, fmt.Errorf("section %d: %v", SECTION_SHARDS, shards.err)
+		}
+	}
+	// blocks encrypted before it have no salt
+	if salts != nil {
+		decodeSalts(salts, st)
+		if salts.err != nil {
+			return nil, fmt.Errorf("section %d: %v", SECTION_SALTS, salts.err)
+		}
+	}
+	return st, nil
+}
+
+func decodeReplicas(d *decoder, st *fsState) {
+	for d.err == nil && !d.done() {
+		i := d.uvarint()
+		s := d.strings()
+		if d.err == nil && (i >= uint64(len(st.Nodes)) || len(st.Nodes[i].Sources) != 1) {
+			d.fail(errors.New("replicas of a node without source"))
+		}
+		if d.err == nil {
+			st.Nodes[i].Sources = append(st.Nodes[i].Sources, s...)
+		}
+	}
+}
+
+func decodeShards(d *decoder, st *fsState) {
+	for d.err == nil && !d.done() {
+		i := d.uvarint()
+		k := d.uvarint()
+		s := d.strings()
+		if d.err == nil && (i >= uint64(len(st.Nodes)) || k == 0 || k > uint64(len(s)) || len(st.Nodes[i].Shards) > 0) {
+			d.fail(errors.New("bad shards"))
+		}
+		if d.err == nil {
+			st.Nodes[i].DataShards = k
+			st.Nodes[i].Shards = s
+		}
+	}
+}
+
+func decodeSalts(d *decoder, st *fsState) {
+	for d.err == nil && !d.done() {
+		i := d.uvarint()
+		t := d.bytes(8)
+		if d.err == nil && (i >= uint64(len(st.Nodes)) || st.Nodes[i].Flags & NODE_ENCRYPTED == 0) {
+			d.fail(errors.New("salt of a node which isn't encrypted"))
+		}
+		if d.err == nil {
+			copy(st.Nodes[i].Salt[:], t)
+		}
+	}
+}
+
+func decodeAttrs(d *decoder, st *fsState) {
+	if d.uvarint() != uint64(len(st.Dirs)) {
+		d.fail(errors.New("wrong number of dirs"))
+	}
+	for i := 0; i < len(st.Dirs) && d.err == nil; i++ {
+		st.Dirs[i].Meta = d.meta()
+	}
+	if d.uvarint() != uint64(len(st.Files)) {
+		d.fail(errors.New("wrong number of files"))
+	}
+	for i := 0; i < len(st.Files) && d.err == nil; i++ {
+		st.Files[i].Meta = d.meta()
+		st.Files[i].Link = d.string()
+	}
+}
+
+// decodeLegacy reads the layout without header, where node hashes, then node
+// flags and the salt, then segment sizes and the journal number were appended
+// one after the other as they were added.
+func decodeLegacy(s []byte) (*fsState, error) {
+	d := &decoder{s: s}
+	st := &fsState{}
+	st.Dirs = make([]Dir, d.count(3))
+	for i := 0; i < len(st.Dirs); i++ {
+		st.Dirs[i].Name = d.runes()
+		st.Dirs[i].Inode = d.uvarint()
+		st.Dirs[i].Child = d.ids(1)
+		st.Dirs[i].Files = d.ids(1)
+	}
+	st.Files = make([]File, d.count(6 + sha512.Size))
+	for i := 0; i < len(st.Files); i++ {
+		f := &st.Files[i]
+		f.Name = d.runes()
+		f.Inode = d.uvarint()
+		f.Size = d.uvarint()
+		f.Storage.NodeId = d.uvarint()
+		f.Storage.NodePos = d.uvarint()
+		copy(f.SHA512[:], d.bytes(sha512.Size))
+		f.Storage.Nodes = d.ids(1)
+	}
+	st.Nodes = make([]Node, d.count(2))
+	for i := 0; i < len(st.Nodes); i++ {
+		st.Nodes[i].Size = d.uvarint()
+		if src := d.runes(); src != "" {
+			st.Nodes[i].Sources = []string{src}
+		}
+	}
+	st.Inodes = d.uvarint()
+	if !d.done() {
+		for i := 0; i < len(st.Nodes); i++ {
+			copy(st.Nodes[i].Hash[:], d.bytes(sha256.Size))
+		}
+	}
+	if !d.done() {
+		for i := 0; i < len(st.Nodes); i++ {
+			st.Nodes[i].Flags = d.uvarint()
+		}
+		copy(st.Salt[:], d.bytes(16))
+	}
+	if !d.done() {
+		for i := 0; i < len(st.Nodes); i++ {
+			if segs := d.ids(1); len(segs) > 0 {
+				st.Nodes[i].Segments = segs
+			}
+		}
+	}
+	if !d.done() {
+		st.Seq = d.uvarint()
+	}
+	if d.err == nil && !d.done() {
+		d.err = errors.New("trailing bytes")
+	}
+	return st, d.err
+}
+
+// decodeState reads fs_data in either layout, and checks that the dirs,
+// files and nodes it links to exist.
+func decodeState(s []byte) (*fsState, error) {
+	var st *fsState
+	var err error
+	if bytes.HasPrefix(s, []byte(FS_DATA_MAGIC)) {
+		st, err = decodeFSData(s)
+	} else {
+		st, err = decodeLegacy(s)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(st.Dirs) == 0 {
+		return nil, errors.New("no root dir")
+	}
+	for i := 0; i < len(st.Dirs); i++ {
+		for _, c := range st.Dirs[i].Child {
+			if c >= uint64(len(st.Dirs)) {
+				return nil, fmt.Errorf("dir %d has a bad child %d", i, c)
+			}
+		}
+		for _, c := range st.Dirs[i].Files {
+			if c >= uint64(len(st.Files)) {
+				return nil, fmt.Errorf("dir %d has a bad file %d", i, c)
+			}
+		}
+	}
+	for i := 0; i < len(st.Files); i++ {
+		if err := checkStorage(st.Files[i].Storage, len(st.Nodes)); err != nil {
+			return nil, fmt.Errorf("file %d: %v", i, err)
+		}
+	}
+	return st, nil
+}
+
+// checkStorage tells if the nodes of storage are all among the first n.
+func checkStorage(storage StorageInfo, n int) error {
+	if storage.NodeId != NullId && storage.NodeId >= uint64(n) {
+		return fmt.Errorf("bad node %d", storage.NodeId)
+	}
+	for _, c := range storage.Nodes {
+		if c >= uint64(n) {
+			return fmt.Errorf("bad node %d", c)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"reflect"
+	"testing"
+)
+
+// legacySaveBytes writes the fs in the original layout of fs_data.
+func legacySaveBytes() []byte {
+	res := make([]byte, 0)
+	res = appendUvarint(res, uint64(len(Dirs)))
+	for i := 0; i < len(Dirs); i++ {
+		ts := []rune(Dirs[i].Name)
+		res = appendUvarint(res, uint64(len(ts)))
+		for j := 0; j < len(ts); j++ {
+			res = appendUvarint(res, uint64(ts[j]))
+		}
+		res = appendUvarint(res, uint64(Dirs[i].Inode))
+		res = appendUvarint(res, uint64(len(Dirs[i].Child)))
+		for j := 0; j < len(Dirs[i].Child); j++ {
+			res = appendUvarint(res, uint64(Dirs[i].Child[j]))
+		}
+		res = appendUvarint(res, uint64(len(Dirs[i].Files)))
+		for j := 0; j < len(Dirs[i].Files); j++ {
+			res = appendUvarint(res, uint64(Dirs[i].Files[j]))
+		}
+	}
+	res = appendUvarint(res, uint64(len(Files)))
+	for i := 0; i < len(Files); i++ {
+		ts := []rune(Files[i].Name)
+		res = appendUvarint(res, uint64(len(ts)))
+		for j := 0; j < len(ts); j++ {
+			res = appendUvarint(res, uint64(ts[j]))
+		}
+		res = appendUvarint(res, uint64(Files[i].Inode))
+		res = appendUvarint(res, uint64(Files[i].Size))
+		res = appendUvarint(res, uint64(Files[i].Storage.NodeId))
+		res = appendUvarint(res, uint64(Files[i].Storage.NodePos))
+		res = append(res, Files[i].SHA512[:]...)
+		res = appendUvarint(res, uint64(len(Files[i].Storage.Nodes)))
+		for j := 0; j < len(Files[i].Storage.Nodes); j++ {
+			res = appendUvarint(res, uint64(Files[i].Storage.Nodes[j]))
+		}
+	}
+	res = appendUvarint(res, uint64(len(Nodes)))
+	for i := 0; i < len(Nodes); i++ {
+		res = appendUvarint(res, uint64(Nodes[i].Size))
+		ts := []rune(mainSource(Nodes[i]))
+		res = appendUvarint(res, uint64(len(ts)))
+		for j := 0; j < len(ts); j++ {
+			res = appendUvarint(res, uint64(ts[j]))
+		}
+	}
+	res = appendUvarint(res, Inodes)
+	return res
+}
+
+// testState fills the fs with a dir, a file on one node and one on two.
+func testState() {
+	clear()
+	a := appendNode(Node{Size: 5, Sources: []string{"0:a|x"}, Hash: sha256.Sum256([]byte("a")), Segments: []uint64{1, 2}})
+	b := appendNode(Node{Size: 7, Sources: []string{"0:b|x", "1:b|x"}, Flags: NODE_ENCRYPTED})
+	c := appendNode(Node{Size: 3, DataShards: 2, Shards: []string{"0:c|x", "1:c|x", "0:d|x"}})
+	FSMutex.Lock()
+	d := addChild(0, "dé")
+	f := addChildFile(d, "f")
+	Files[f].Size = 5
+	Files[f].SHA512[0] = 7
+	Files[f].Storage = StorageInfo{a, 0, []uint64{}}
+	g := addChildFile(0, "g")
+	Files[g].Size = 10
+	Files[g].Storage = StorageInfo{NullId, 0, []uint64{b, c}}
+	FSMutex.Unlock()
+}
+
+// resum makes the checksum of fs_data s right again after it was changed.
+func resum(s []byte) {
+	sum := sha256.Sum256(s[:len(s) - sha256.Size])
+	copy(s[len(s) - sha256.Size:], sum[:])
+}
+
+func TestFSDataRoundtrip(t *testing.T) {
+	testState()
+	CryptSalt[3] = 9
+	JournalSeq = 42
+	Files[0].Meta.Mode = 0600
+	dirs := append([]Dir{}, Dirs...)
+	files := append([]File{}, Files...)
+	nodes := append([]Node{}, Nodes...)
+	s := saveBytes()
+	clear()
+	CryptSalt = [16]byte{}
+	JournalSeq = 0
+	err := loadBytes(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(saveBytes(), s) {
+		t.Fatal("saved again differently")
+	}
+	if CryptSalt[3] != 9 || JournalSeq != 42 {
+		t.Fatal("salt or journal seq lost")
+	}
+	for i := range dirs {
+		if Dirs[i].Name != dirs[i].Name || Dirs[i].Inode != dirs[i].Inode || !reflect.DeepEqual(Dirs[i].ChildMap, dirs[i].ChildMap) || !reflect.DeepEqual(Dirs[i].FilesMap, dirs[i].FilesMap) {
+			t.Fatal("dir", i, Dirs[i])
+		}
+	}
+	if !reflect.DeepEqual(Files, files) {
+		t.Fatal(Files, files)
+	}
+	if !reflect.DeepEqual(Nodes, nodes) {
+		t.Fatal(Nodes, nodes)
+	}
+}
+
+func TestDecodeLegacy(t *testing.T) {
+	testState()
+	s := legacySaveBytes()
+	d := getChild(0, "dé")
+	f := getChildFile(d, "f")
+	g := getChildFile(0, "g")
+	storage := Files[g].Storage
+	clear()
+	err := loadBytes(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getChild(0, "dé") != d || getChildFile(d, "f") != f || getChildFile(0, "g") != g {
+		t.Fatal("names")
+	}
+	if !reflect.DeepEqual(Files[g].Storage, storage) || Files[f].SHA512[0] != 7 {
+		t.Fatal("files", Files)
+	}
+	if len(Nodes) != 3 || mainSource(Nodes[0]) != "0:a|x" || Nodes[0].Size != 5 || Nodes[0].Flags != 0 {
+		t.Fatal("nodes", Nodes)
+	}
+	// the original layout has nothing after the inodes
+	if _, err := decodeState(append(s, 0)); err == nil {
+		t.Fatal("trailing bytes accepted")
+	}
+}
+
+// fs_data written before the sections of metadata, replicas and shards were
+// added loads with the defaults, and so does the original layout with what
+// was appended to it before fs_data had a header.
+func TestDecodeOlderSections(t *testing.T) {
+	testState()
+	Files[0].Meta.Mode = 0600
+	s := saveBytes()
+	d := &decoder{s: s[:len(s) - sha256.Size], n: len(FS_DATA_MAGIC)}
+	old := appendUvarint([]byte(FS_DATA_MAGIC), d.uvarint())
+	for d.err == nil && !d.done() {
+		tag := d.uvarint()
+		t := d.bytes(d.uvarint())
+		if tag < SECTION_ATTRS {
+			old = appendSection(old, tag, t)
+		}
+	}
+	sum := sha256.Sum256(old)
+	st, err := decodeState(append(old, sum[:]...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Files[0].Meta != (Meta{}) || len(st.Nodes[1].Sources) != 1 || st.Nodes[1].Salt != [8]byte{} || st.Nodes[2].Shards != nil || st.Nodes[2].DataShards != 0 {
+		t.Fatal("later sections", st.Files[0], st.Nodes)
+	}
+	if st.Nodes[0].Hash != Nodes[0].Hash || !reflect.DeepEqual(st.Nodes[0].Segments, Nodes[0].Segments) {
+		t.Fatal("nodes", st.Nodes)
+	}
+
+	s = legacySaveBytes()
+	for i := range Nodes {
+		s = append(s, Nodes[i].Hash[:]...)
+	}
+	for i := range Nodes {
+		s = appendUvarint(s, uint64(i))
+	}
+	s = append(s, make([]byte, 16)...)
+	for i := range Nodes {
+		s = appendUvarint(s, uint64(len(Nodes[i].Segments)))
+		for _, c := range Nodes[i].Segments {
+			s = appendUvarint(s, c)
+		}
+	}
+	s = appendUvarint(s, 42)
+	st, err = decodeState(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.Nodes[0].Hash != Nodes[0].Hash || st.Nodes[2].Flags != 2 || !reflect.DeepEqual(st.Nodes[0].Segments, Nodes[0].Segments) || st.Seq != 42 {
+		t.Fatal("appended to the original layout", st.Nodes, st.Seq)
+	}
+}
+
+func TestDecodeVersion(t *testing.T) {
+	s := append([]byte(FS_DATA_MAGIC), FS_DATA_VERSION + 1)
+	sum := sha256.Sum256(s)
+	if _, err := decodeState(append(s, sum[:]...)); err == nil {
+		t.Fatal("newer version accepted")
+	}
+}
+
+func TestDecodeBadNode(t *testing.T) {
+	testState()
+	if _, err := decodeState(saveBytes()); err != nil {
+		t.Fatal(err)
+	}
+	for _, storage := range []StorageInfo{{3, 0, []uint64{}}, {NullId, 0, []uint64{0, 3}}} {
+		testState()
+		Files[len(Files) - 1].Storage = storage
+		if _, err := decodeState(saveBytes()); err == nil {
+			t.Fatal("no error for", storage)
+		}
+	}
+}
+
+// Truncated and damaged fs_data, in both layouts, must give an error rather
+// than a panic or a state pointing past Nodes.
+func TestDecodeCorrupt(t *testing.T) {
+	testState()
+	for k, s := range [][]byte{saveBytes(), legacySaveBytes()} {
+		check := func(b []byte) {
+			defer func() {
+				if e := recover(); e != nil {
+					t.Fatalf("panic on %x: %v", b, e)
+				}
+			}()
+			st, err := decodeState(b)
+			if err != nil {
+				return
+			}
+			for i := range st.Files {
+				if checkStorage(st.Files[i].Storage, len(st.Nodes)) != nil {
+					t.Fatalf("bad file %d accepted in %x", i, b)
+				}
+			}
+		}
+		fsData := k == 0
+		for n := 0; n < len(s); n++ {
+			b := append([]byte{}, s[:n]...)
+			if fsData && n >= len(FS_DATA_MAGIC) + sha256.Size {
+				resum(b)
+			}
+			check(b)
+		}
+		for i := 0; i < len(s) * 8; i++ {
+			b := append([]byte{}, s...)
+			b[i / 8] ^= 1 << uint(i % 8)
+			if fsData {
+				resum(b)
+			}
+			check(b)
+		}
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/gob"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"./backend"
+)
+
+// gc runs in two phases. First the new fs_data, without the dead nodes and
+// the files and dirs that can't be reached, is written to GC_PLAN_FILE along
+// with the sources to delete, and then saved as fs_data. Then the sources are
+// deleted from the drive. If it stops midway, running gc again resumes it.
+// Sources which still can't be deleted after GC_DELETE_TRIES are kept in the
+// plan for the next run.
+type GCPlan struct {
+	// fs_data before and after gc
+	OldHash [sha256.Size]byte
+	Data []byte
+	Applied bool
+	Sources []string
+	Done int
+	Failed []string
+}
+
+const GC_DELETE_TRIES = 5
+
+var fsLock *os.File
+
+// lockFS takes the lock on fs_data, shared for mount, copy, fix and backup,
+// which only add nodes or read them, and exclusive for gc, which renumbers
+// them.
+func lockFS(exclusive bool) {
+	var err error
+	fsLock, err = os.OpenFile(FS_LOCK_FILE, os.O_RDWR | os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	how := syscall.LOCK_SH
+	if exclusive {
+		how = syscall.LOCK_EX
+	}
+	err = syscall.Flock(int(fsLock.Fd()), how | syscall.LOCK_NB)
+	if err != nil {
+		log.Fatal("fs_data is in use (is it mounted?): ", err)
+	}
+}
+
+func writeGCPlan(p *GCPlan) {
+	tmp := GC_PLAN_FILE + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = gob.NewEncoder(f).Encode(p)
+	if err == nil {
+		err = f.Sync()
+	}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, GC_PLAN_FILE)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func readGCPlan() *GCPlan {
+	f, err := os.Open(GC_PLAN_FILE)
+	if err != nil {
+		return nil
+	}
+	defer f.Close()
+	p := &GCPlan{}
+	err = gob.NewDecoder(f).Decode(p)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return p
+}
+
+// compactDir appends dir x and everything below it to dirs and files,
+// returning its new id.
+func compactDir(x uint64, dirs *[]Dir, files *[]File) uint64 {
+	n := uint64(len(*dirs))
+	*dirs = append(*dirs, Dirs[x])
+	child := make([]uint64, 0, len(Dirs[x].Child))
+	for _, c := range Dirs[x].Child {
+		child = append(child, compactDir(c, dirs, files))
+	}
+	fl := make([]uint64, 0, len(Dirs[x].Files))
+	for _, i := range Dirs[x].Files {
+		fl = append(fl, uint64(len(*files)))
+		*files = append(*files, Files[i])
+	}
+	(*dirs)[n].Child = child
+	(*dirs)[n].Files = fl
+	return n
+}
+
+// compact drops the dirs and files which can't be reached from the root and
+// the nodes no file uses. It returns the new id of every node, NullId for
+// those dropped, and the sources of the dropped ones.
+func compact() ([]uint64, []string) {
+	used := nodeRefs()
+	newId := make([]uint64, len(Nodes))
+	nodes := make([]Node, 0)
+	dead := make([]string, 0)
+	for i := 0; i < len(Nodes); i++ {
+		if used[i] == 0 {
+			newId[i] = NullId
+			dead = append(dead, Nodes[i].Sources...)
+			for _, src := range Nodes[i].Shards {
+				if src != "" {
+					dead = append(dead, src)
+				}
+			}
+			continue
+		}
+		newId[i] = uint64(len(nodes))
+		nodes = append(nodes, Nodes[i])
+	}
+	dirs := make([]Dir, 0)
+	files := make([]File, 0)
+	compactDir(0, &dirs, &files)
+	for i := 0; i < len(files); i++ {
+		s := &files[i].Storage
+		if len(s.Nodes) == 0 {
+			if s.NodeId < uint64(len(newId)) {
+				s.NodeId = newId[s.NodeId]
+			} else {
+				s.NodeId = NullId
+			}
+			continue
+		}
+		t := make([]uint64, len(s.Nodes))
+		for j := 0; j < len(t); j++ {
+			t[j] = newId[s.Nodes[j]]
+		}
+		s.Nodes = t
+	}
+	Dirs = dirs
+	Files = files
+	Nodes = nodes
+	return newId, dead
+}
+
+// cleanTmp removes the tmp files of nodes which are uploaded or unused. gc
+// can't go on while a used node is still waiting for its upload.
+func cleanTmp() {
+	used := nodeRefs()
+	files, err := ioutil.ReadDir(TMP_PATH)
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, t := range files {
+		// encrypted copies and shards are named after the node too, and
+		// so are those of repair, after an "r"
+		name := strings.TrimPrefix(t.Name(), "r")
+		if pos := strings.Index(name, "."); pos != -1 {
+			name = name[:pos]
+		}
+		i, err := strconv.ParseUint(name, 10, 64)
+		if err != nil {
+			continue
+		}
+		if i < uint64(len(Nodes)) && !uploaded(Nodes[i]) && used[i] > 0 {
+			log.Fatal("node ", i, " is not uploaded yet, run fix on its files first")
+		}
+		os.Remove(TMP_PATH + t.Name())
+	}
+}
+
+// deleteSource deletes a source from the remote, retrying a few times, and
+// tells if it is gone.
+func deleteSource(src string) bool {
+	for i := 0; i < GC_DELETE_TRIES; i++ {
+		err := Remote.Delete(src)
+		if err == nil || err == backend.ErrNotFound {
+			return true
+		}
+		fmt.Println(err)
+		if i + 1 < GC_DELETE_TRIES {
+			time.Sleep(time.Duration(1 << uint(i)) * time.Second)
+		}
+	}
+	return false
+}
+
+// gcMain tells if every source was deleted.
+func gcMain() bool {
+	lockFS(true)
+	load()
+	old, err := ioutil.ReadFile(FS_DATA_FILE)
+	if err != nil {
+		log.Fatal(err)
+	}
+	p := readGCPlan()
+	if p == nil {
+		cleanTmp()
+		loadCacheIndex()
+		newId, dead := compact()
+		fmt.Println("gc:", len(newId) - len(Nodes), "unused nodes,", len(dead), "to delete")
+		p = &GCPlan{OldHash: sha256.Sum256(old), Data: saveBytes(), Sources: dead}
+		writeGCPlan(p)
+		writeFSData(p.Data)
+		os.Remove(JOURNAL_FILE)
+		// the cache is renamed without index, so that nothing wrong is
+		// adopted if we stop before it is saved again
+		os.Remove(CACHE_INDEX_FILE)
+		renumberNodeState(newId)
+		if err := loadBytes(p.Data); err != nil {
+			log.Fatal(err)
+		}
+		saveCacheIndex()
+		p.Applied = true
+		writeGCPlan(p)
+	} else if !p.Applied {
+		// stopped before fs_data was surely saved, which must not have been
+		// changed by anything else meanwhile
+		if sha256.Sum256(old) != p.OldHash && sha256.Sum256(old) != sha256.Sum256(p.Data) || journalApplied > 0 {
+			log.Fatal("fs_data changed since ", GC_PLAN_FILE, " was written, remove it to start over")
+		}
+		writeFSData(p.Data)
+		os.Remove(JOURNAL_FILE)
+		p.Applied = true
+		writeGCPlan(p)
+	}
+	for ; p.Done < len(p.Sources); p.Done++ {
+		fmt.Printf("delete %d/%d %s\n", p.Done + 1, len(p.Sources), p.Sources[p.Done])
+		if !deleteSource(p.Sources[p.Done]) {
+			p.Failed = append(p.Failed, p.Sources[p.Done])
+		}
+		if p.Done % 100 == 99 {
+			writeGCPlan(p)
+		}
+	}
+	if len(p.Failed) > 0 {
+		p.Sources = p.Failed
+		p.Failed = nil
+		p.Done = 0
+		writeGCPlan(p)
+		fmt.Println(len(p.Sources), "sources could not be deleted, run gc again to retry them")
+		return false
+	}
+	os.Remove(GC_PLAN_FILE)
+	fmt.Println("gc ok")
+	return true
+}
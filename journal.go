@@ -0,0 +1,516 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"fmt"
+	"hash/crc32"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+)
+
+// Changes made since fs_data was saved are appended to JOURNAL_FILE, and
+// replayed on load. Each record is its length, then the record, then its
+// CRC32; a record cut short by a crash ends the replay. Records are numbered,
+// fs_data remembers the last number it includes, and older ones are skipped.
+const (
+	J_DIR = 1
+	J_NEW_FILE = 2
+	J_FILE = 3
+	J_NODE = 4
+	J_SALT = 5
+	J_ATTR = 6
+	J_REMOVE = 7
+	J_RENAME = 8
+)
+
+// fs_data is saved, and the journal emptied, every JOURNAL_SAVE_INTERVAL
+// while mounted if something was journaled.
+const JOURNAL_SAVE_INTERVAL = 10 * time.Minute
+
+var JournalFile *os.File
+var JournalSeq uint64
+var JournalMutex sync.Mutex
+// length of the valid part of the journal and the number of records applied
+// by the last load
+var journalValid int64
+var journalApplied int
+
+var SaveMutex sync.Mutex
+
+// only the process holding WRITER_LOCK_FILE changes fs_data and the journal
+var writerLock *os.File
+var Writer bool
+var WriterMutex sync.Mutex
+
+// journal appends a record of type typ, fsyncing it. Nothing is written by
+// processes that aren't the writer.
+func journal(typ byte, body []byte) {
+	JournalMutex.Lock()
+	defer JournalMutex.Unlock()
+	if JournalFile == nil {
+		return
+	}
+	JournalSeq++
+	t := appendUvarint([]byte{typ}, JournalSeq)
+	t = append(t, body...)
+	res := appendUvarint(make([]byte, 0), uint64(len(t)))
+	res = append(res, t...)
+	res = append(res, 0, 0, 0, 0)
+	binary.BigEndian.PutUint32(res[len(res) - 4:], crc32.ChecksumIEEE(t))
+	_, err := JournalFile.Write(res)
+	if err == nil {
+		err = JournalFile.Sync()
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+func journalDir(x, n uint64) {
+	res := appendUvarint(make([]byte, 0), n)
+	res = appendUvarint(res, x)
+	res = appendUvarint(res, Dirs[n].Inode)
+	res = appendString(res, Dirs[n].Name)
+	journal(J_DIR, res)
+}
+
+func journalNewFile(x, n uint64) {
+	res := appendUvarint(make([]byte, 0), n)
+	res = appendUvarint(res, x)
+	res = appendUvarint(res, Files[n].Inode)
+	res = appendString(res, Files[n].Name)
+	journal(J_NEW_FILE, res)
+}
+
+// journalFile records the content of file n, once it is packed.
+func journalFile(n uint64) {
+	res := appendUvarint(make([]byte, 0), n)
+	res = appendUvarint(res, Files[n].Inode)
+	res = appendUvarint(res, Files[n].Size)
+	res = append(res, Files[n].SHA512[:]...)
+	res = appendUvarint(res, Files[n].Storage.NodeId)
+	res = appendUvarint(res, Files[n].Storage.NodePos)
+	res = appendUvarint(res, uint64(len(Files[n].Storage.Nodes)))
+	for _, t := range Files[n].Storage.Nodes {
+		res = appendUvarint(res, t)
+	}
+	res = appendMeta(res, Files[n].Meta)
+	res = appendString(res, Files[n].Link)
+	journal(J_FILE, res)
+}
+
+// journalAttr records the metadata of dir or file n.
+func journalAttr(n uint64, dir bool) {
+	res := appendUvarint(make([]byte, 0), n)
+	if dir {
+		res = appendUvarint(res, 1)
+		res = appendMeta(res, Dirs[n].Meta)
+	} else {
+		res = appendUvarint(res, 0)
+		res = appendMeta(res, Files[n].Meta)
+	}
+	journal(J_ATTR, res)
+}
+
+func journalNode(n uint64) {
+	res := appendUvarint(make([]byte, 0), n)
+	res = appendUvarint(res, Nodes[n].Size)
+	res = appendUvarint(res, Nodes[n].Flags)
+	res = append(res, Nodes[n].Hash[:]...)
+	res = appendUvarint(res, uint64(len(Nodes[n].Segments)))
+	for _, t := range Nodes[n].Segments {
+		res = appendUvarint(res, t)
+	}
+	res = appendString(res, mainSource(Nodes[n]))
+	res = appendStrings(res, replicaSources(Nodes[n]))
+	res = appendUvarint(res, Nodes[n].DataShards)
+	res = appendStrings(res, Nodes[n].Shards)
+	res = append(res, Nodes[n].Salt[:]...)
+	journal(J_NODE, res)
+}
+
+// journalRemove records that dir or file n was removed from dir x.
+func journalRemove(x, n uint64, dir bool) {
+	res := appendUvarint(make([]byte, 0), n)
+	res = appendUvarint(res, x)
+	if dir {
+		res = appendUvarint(res, 1)
+	} else {
+		res = appendUvarint(res, 0)
+	}
+	journal(J_REMOVE, res)
+}
+
+// journalRename records a rename of x/a to y/b, which replay does again.
+func journalRename(x uint64, a string, y uint64, b string) {
+	res := appendUvarint(make([]byte, 0), x)
+	res = appendString(res, a)
+	res = appendUvarint(res, y)
+	res = appendString(res, b)
+	journal(J_RENAME, res)
+}
+
+func journalSalt() {
+	journal(J_SALT, append(make([]byte, 0), CryptSalt[:]...))
+}
+
+func newDir(name string, inode uint64) Dir {
+	return Dir{Name: name, Inode: inode, Child: make([]uint64, 0), Files: make([]uint64, 0),
+		ChildMap: make(map[string]uint64, 0), FilesMap: make(map[string]uint64, 0)}
+}
+
+// replay applies record t, a new file is noted in created until its content
+// comes. FSMutex must be held.
+func replay(t []byte, created map[uint64]uint64) bool {
+	r := &decoder{s: t, n: 1}
+	seq := r.uvarint()
+	if seq > JournalSeq {
+		JournalSeq = seq
+	} else if r.err == nil {
+		return true
+	}
+	switch t[0] {
+	case J_DIR, J_NEW_FILE:
+		n := r.uvarint()
+		x := r.uvarint()
+		inode := r.uvarint()
+		name := r.string()
+		if r.err != nil || x >= uint64(len(Dirs)) {
+			return false
+		}
+		if inode > Inodes {
+			Inodes = inode
+		}
+		_, ok1 := Dirs[x].ChildMap[name]
+		_, ok2 := Dirs[x].FilesMap[name]
+		if t[0] == J_DIR {
+			if n < uint64(len(Dirs)) {
+				return true
+			}
+			// dirs that never made it become tombstones
+			for uint64(len(Dirs)) < n {
+				Dirs = append(Dirs, newDir("", 0))
+			}
+			Dirs = append(Dirs, newDir("", inode))
+			if !ok1 && !ok2 {
+				linkChild(x, n, name)
+			}
+		} else {
+			if n < uint64(len(Files)) {
+				return true
+			}
+			for uint64(len(Files)) <= n {
+				Files = append(Files, File{Storage: noStorage()})
+			}
+			Files[n].Inode = inode
+			if !ok1 && !ok2 {
+				linkChildFile(x, n, name)
+				created[n] = x
+			}
+		}
+	case J_FILE:
+		n := r.uvarint()
+		var f File
+		f.Inode = r.uvarint()
+		f.Size = r.uvarint()
+		copy(f.SHA512[:], r.bytes(sha512.Size))
+		f.Storage.NodeId = r.uvarint()
+		f.Storage.NodePos = r.uvarint()
+		f.Storage.Nodes = r.ids(1)
+		// records from before metadata end here
+		if r.err == nil && !r.done() {
+			f.Meta = r.meta()
+			f.Link = r.string()
+		}
+		if r.err != nil || checkStorage(f.Storage, len(Nodes)) != nil {
+			return false
+		}
+		for uint64(len(Files)) <= n {
+			Files = append(Files, File{Storage: noStorage()})
+		}
+		dropLookup(n)
+		f.Name = Files[n].Name
+		Files[n] = f
+		delete(created, n)
+		if f.Name != "" {
+			SHA512Lookup[f.SHA512] = n
+		}
+	case J_NODE:
+		n := r.uvarint()
+		var node Node
+		node.Size = r.uvarint()
+		node.Flags = r.uvarint()
+		copy(node.Hash[:], r.bytes(sha256.Size))
+		if segs := r.ids(1); len(segs) > 0 {
+			node.Segments = segs
+		}
+		if src := r.string(); src != "" {
+			node.Sources = []string{src}
+		}
+		// records from before replicas end here
+		if r.err == nil && !r.done() {
+			node.Sources = append(node.Sources, r.strings()...)
+		}
+		// and here before erasure coding
+		if r.err == nil && !r.done() {
+			node.DataShards = r.uvarint()
+			if shards := r.strings(); len(shards) > 0 {
+				node.Shards = shards
+			}
+		}
+		// and here before blocks had their own salt
+		if r.err == nil && !r.done() {
+			copy(node.Salt[:], r.bytes(8))
+		}
+		if r.err != nil {
+			return false
+		}
+		for uint64(len(Nodes)) <= n {
+			Nodes = append(Nodes, Node{})
+		}
+		Nodes[n] = node
+	case J_ATTR:
+		n := r.uvarint()
+		dir := r.uvarint() == 1
+		m := r.meta()
+		if r.err != nil {
+			return false
+		}
+		if dir && n < uint64(len(Dirs)) {
+			Dirs[n].Meta = m
+		} else if !dir && n < uint64(len(Files)) {
+			Files[n].Meta = m
+		}
+	case J_REMOVE:
+		n := r.uvarint()
+		x := r.uvarint()
+		dir := r.uvarint() == 1
+		if r.err != nil || x >= uint64(len(Dirs)) {
+			return false
+		}
+		if dir && n < uint64(len(Dirs)) {
+			if t, ok := Dirs[x].ChildMap[Dirs[n].Name]; ok && t == n {
+				removeDir(x, n)
+			}
+		} else if !dir && n < uint64(len(Files)) {
+			if t, ok := Dirs[x].FilesMap[Files[n].Name]; ok && t == n {
+				removeFile(x, n)
+			}
+		}
+	case J_RENAME:
+		x := r.uvarint()
+		a := r.string()
+		y := r.uvarint()
+		b := r.string()
+		if r.err != nil || x >= uint64(len(Dirs)) || y >= uint64(len(Dirs)) {
+			return false
+		}
+		if rename(x, a, y, b) == nil {
+			// a new file still waiting for its content moved
+			if n, ok := Dirs[y].FilesMap[b]; ok {
+				if _, ok = created[n]; ok {
+					created[n] = y
+				}
+			}
+		}
+	case J_SALT:
+		copy(CryptSalt[:], r.bytes(16))
+	default:
+		return false
+	}
+	return r.err == nil
+}
+
+// replayJournal applies the journal on top of what was loaded from fs_data.
+func replayJournal() {
+	s, err := ioutil.ReadFile(JOURNAL_FILE)
+	if err != nil && !os.IsNotExist(err) {
+		log.Fatal(err)
+	}
+	FSMutex.Lock()
+	CacheListMutex.Lock()
+	JournalMutex.Lock()
+	created := make(map[uint64]uint64)
+	var n uint64
+	journalApplied = 0
+	for n < uint64(len(s)) {
+		a, b := binary.Uvarint(s[n:])
+		if b <= 0 || a == 0 || a > uint64(len(s)) || n + uint64(b) + a + 4 > uint64(len(s)) {
+			break
+		}
+		t := s[n + uint64(b): n + uint64(b) + a]
+		if crc32.ChecksumIEEE(t) != binary.BigEndian.Uint32(s[n + uint64(b) + a:]) {
+			break
+		}
+		if !replay(t, created) {
+			log.Print("journal record at ", n, " can't be applied")
+			break
+		}
+		n += uint64(b) + a + 4
+		journalApplied++
+	}
+	if n < uint64(len(s)) {
+		log.Print("journal ends with ", uint64(len(s)) - n, " bad bytes, ignored")
+	}
+	journalValid = int64(n)
+	// files whose content didn't make it are dropped
+	for i, x := range created {
+		if t, ok := Dirs[x].FilesMap[Files[i].Name]; ok && t == i {
+			removeFile(x, i)
+		}
+	}
+	resizeNodeState(len(Nodes))
+	JournalMutex.Unlock()
+	CacheListMutex.Unlock()
+	FSMutex.Unlock()
+	if journalApplied > 0 {
+		log.Print("journal: ", journalApplied, " changes replayed")
+	}
+}
+
+// saveLoop saves fs_data every JOURNAL_SAVE_INTERVAL, so that the journal
+// doesn't grow for ever with changes which commit nothing, as mkdir or rename.
+func saveLoop() {
+	for true {
+		time.Sleep(JOURNAL_SAVE_INTERVAL)
+		if !Writer {
+			continue
+		}
+		JournalMutex.Lock()
+		dirty := false
+		if JournalFile != nil {
+			st, err := JournalFile.Stat()
+			dirty = err == nil && st.Size() > 0
+		}
+		JournalMutex.Unlock()
+		if dirty {
+			save()
+		}
+	}
+}
+
+// openJournal opens the journal for appending, cutting off what the last
+// load couldn't read.
+func openJournal() {
+	f, err := os.OpenFile(JOURNAL_FILE, os.O_RDWR | os.O_CREATE | os.O_APPEND, 0644)
+	if err == nil {
+		err = f.Truncate(journalValid)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	JournalMutex.Lock()
+	JournalFile = f
+	JournalMutex.Unlock()
+}
+
+// resetJournal empties the journal if nothing was added after record seq.
+func resetJournal(seq uint64) {
+	JournalMutex.Lock()
+	defer JournalMutex.Unlock()
+	if JournalFile == nil || JournalSeq != seq {
+		return
+	}
+	err := JournalFile.Truncate(0)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// lockWriter makes this process the one changing fs_data, loading the latest
+// one. It returns false if another process is.
+func lockWriter() bool {
+	return takeWriter(true)
+}
+
+// loadMore is load for a mount, whose open files and cached nodes keep ids
+// into the tables. Other processes only add to fs_data while it is mounted,
+// so it fails if fewer dirs, files or nodes come back.
+func loadMore() error {
+	FSMutex.Lock()
+	dirs, files, nodes := len(Dirs), len(Files), len(Nodes)
+	FSMutex.Unlock()
+	load()
+	FSMutex.Lock()
+	defer FSMutex.Unlock()
+	if len(Dirs) < dirs || len(Files) < files || len(Nodes) < nodes {
+		return fmt.Errorf("fs_data has %d dirs, %d files and %d nodes, fewer than the %d, %d and %d of the mount: was it replaced while mounted?", len(Dirs), len(Files), len(Nodes), dirs, files, nodes)
+	}
+	return nil
+}
+
+// takeWriter is lockWriter, resuming the interrupted uploads if resume.
+func takeWriter(resume bool) bool {
+	WriterMutex.Lock()
+	defer WriterMutex.Unlock()
+	if Writer {
+		return true
+	}
+	f, err := os.OpenFile(WRITER_LOCK_FILE, os.O_RDWR | os.O_CREATE, 0644)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX | syscall.LOCK_NB)
+	if err != nil {
+		f.Close()
+		return false
+	}
+	writerLock = f
+	// files of the mount may be open, their ids have to stay valid
+	if err := loadMore(); err != nil {
+		log.Fatal(err)
+	}
+	openJournal()
+	Writer = true
+	if journalApplied > 0 {
+		save()
+	}
+	if resume {
+		resumeUploads()
+	}
+	return true
+}
+
+// writable is lockWriter for changes made on the mount.
+func writable() error {
+	if !lockWriter() {
+		log.Print("fs_data is being changed by another process")
+		return fuse.Errno(syscall.EROFS)
+	}
+	return nil
+}
+
+// resumeUploads uploads again the used nodes whose upload was interrupted.
+func resumeUploads() {
+	FSMutex.Lock()
+	used := nodeRefs()
+	ids := make([]uint64, 0)
+	for i := 0; i < len(Nodes); i++ {
+		if uploaded(Nodes[i]) || used[i] == 0 {
+			continue
+		}
+		if _, err := os.Stat(TMP_PATH + strconv.FormatUint(uint64(i), 10)); err == nil {
+			ids = append(ids, uint64(i))
+		}
+	}
+	FSMutex.Unlock()
+	for _, i := range ids {
+		log.Print("resume upload of node ", i)
+		startUpload(i)
+	}
+}
+
+func mustLockWriter() {
+	if !lockWriter() {
+		log.Fatal("fs_data is being changed by another process (", WRITER_LOCK_FILE, ")")
+	}
+}
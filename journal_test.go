@@ -0,0 +1,203 @@
+package main
+
+import (
+	"os"
+	"testing"
+
+	"bazil.org/fuse"
+)
+
+func TestJournalReplay(t *testing.T) {
+	defer testFS(t, "local")()
+	writeTree(t, "src", map[string][]byte{"x": []byte("xxxx"), "sub/y": []byte("yyyyyy")})
+	copyPath("src", "/dst")
+	waitUploads()
+	FSMutex.Lock()
+	ghost := addChildFile(0, "ghost")
+	FSMutex.Unlock()
+	crashWriter()
+	// a record cut by the crash
+	f, _ := os.OpenFile(JOURNAL_FILE, os.O_WRONLY | os.O_APPEND, 0644)
+	f.Write([]byte{40, 1, 2, 3})
+	f.Close()
+	if _, err := os.Stat(FS_DATA_FILE); err == nil {
+		t.Fatal("fs_data saved")
+	}
+	reload()
+	if Files[ghost].Name != "" || fileId("/ghost") != NullId {
+		t.Fatal("file without content kept")
+	}
+	if string(readFile(t, "/dst/x")) != "xxxx" || string(readFile(t, "/dst/sub/y")) != "yyyyyy" {
+		t.Fatal("content")
+	}
+	for i := range Nodes {
+		if mainSource(Nodes[i]) == "" {
+			t.Fatal("source of node", i, "lost")
+		}
+	}
+
+	// the next writer starts from the replayed fs, and saving empties the
+	// journal
+	writeTree(t, "src", map[string][]byte{"z": []byte("zz")})
+	mustLockWriter()
+	copyPath("src", "/dst")
+	waitUploads()
+	save()
+	st, _ := os.Stat(JOURNAL_FILE)
+	if st.Size() != 0 {
+		t.Fatal("journal not emptied", st.Size())
+	}
+	reload()
+	if string(readFile(t, "/dst/x")) != "xxxx" || string(readFile(t, "/dst/z")) != "zz" {
+		t.Fatal("content after save")
+	}
+	d, _ := getPath("/dst")
+	if len(Dirs[d].Files) != 2 {
+		t.Fatal("files copied twice", Dirs[d].Files)
+	}
+}
+
+func TestJournalNamespace(t *testing.T) {
+	defer testFS(t, "local")()
+	writeTree(t, "src", map[string][]byte{"x": []byte("xxxx"), "y": []byte("yyyy"), "z": []byte("zzzz"), "z2": []byte("zzzz")})
+	copyPath("src", "/dst")
+	waitUploads()
+	save()
+	id, _ := getPath("/dst")
+	d := FuseDir{id}
+	if _, err := d.Mkdir(nil, &fuse.MkdirRequest{Name: "a", Mode: 0755 | os.ModeDir}); err != nil {
+		t.Fatal(err)
+	}
+	id, _ = getPath("/dst/a")
+	a := FuseDir{id}
+	if _, err := a.Symlink(nil, &fuse.SymlinkRequest{NewName: "l", Target: "../x"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Rename(nil, &fuse.RenameRequest{OldName: "x", NewName: "x2"}, a); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Rename(nil, &fuse.RenameRequest{OldName: "y", NewName: "z"}, d); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := d.Mkdir(nil, &fuse.MkdirRequest{Name: "b", Mode: 0755 | os.ModeDir}); err != nil {
+		t.Fatal(err)
+	}
+	if err := d.Remove(nil, &fuse.RemoveRequest{Name: "b", Dir: true}); err != nil {
+		t.Fatal(err)
+	}
+	if err := a.Remove(nil, &fuse.RemoveRequest{Name: "l"}); err != nil {
+		t.Fatal(err)
+	}
+	// z2 has the content of the z replaced above, the lookup must have gone
+	// to it, and go with it
+	w := fileId("/dst/z2")
+	hash := Files[w].SHA512
+	if SHA512Lookup[hash] != w {
+		t.Fatal("lookup not moved to z2")
+	}
+	if err := d.Remove(nil, &fuse.RemoveRequest{Name: "z2"}); err != nil {
+		t.Fatal(err)
+	}
+	// a new file renamed before its content came is dropped all the same
+	FSMutex.Lock()
+	g := addChildFile(d.Id, "g")
+	rename(d.Id, "g", a.Id, "g2")
+	journalRename(d.Id, "g", a.Id, "g2")
+	FSMutex.Unlock()
+	reload()
+	if fileId("/dst/a/x2") == NullId || fileId("/dst/x") != NullId || fileId("/dst/y") != NullId {
+		t.Fatal("renames")
+	}
+	if _, e := getPath("/dst/b"); e == 0 {
+		t.Fatal("removed dir kept")
+	}
+	if fileId("/dst/a/l") != NullId || fileId("/dst/z2") != NullId || Files[w].Name != "" {
+		t.Fatal("removed files kept")
+	}
+	if fileId("/dst/a/g2") != NullId || Files[g].Name != "" {
+		t.Fatal("file without content kept", Files[g])
+	}
+	if string(readFile(t, "/dst/z")) != "yyyy" {
+		t.Fatal("z is not the old y")
+	}
+	if _, ok := SHA512Lookup[hash]; ok {
+		t.Fatal("lookup of a removed file")
+	}
+}
+
+// A record pointing to a node which isn't there ends the replay instead of
+// being applied.
+func TestJournalBadNode(t *testing.T) {
+	defer testFS(t, "local")()
+	writeTree(t, "src", map[string][]byte{"x": []byte("xxxx")})
+	copyPath("src", "/dst")
+	waitUploads()
+	x := fileId("/dst/x")
+	FSMutex.Lock()
+	storage := Files[x].Storage
+	Files[x].Storage.NodeId = uint64(len(Nodes)) + 10
+	journalFile(x)
+	Files[x].Storage = StorageInfo{NullId, 0, []uint64{uint64(len(Nodes))}}
+	journalFile(x)
+	FSMutex.Unlock()
+	reload()
+	if string(readFile(t, "/dst/x")) != "xxxx" || Files[x].Storage.NodeId != storage.NodeId {
+		t.Fatal("bad record applied", Files[x].Storage)
+	}
+}
+
+// Records written before metadata, replicas and shards were journaled are
+// still replayed, with the defaults for what they lack.
+func TestJournalOlderRecords(t *testing.T) {
+	defer testFS(t, "local")()
+	writeTree(t, "src", map[string][]byte{"x": []byte("xxxx")})
+	copyPath("src", "/dst")
+	waitUploads()
+	x := fileId("/dst/x")
+	FSMutex.Lock()
+	Files[x].Meta.Mode = 0600
+	journalFile(x)
+	res := appendUvarint(make([]byte, 0), x)
+	res = appendUvarint(res, Files[x].Inode)
+	res = appendUvarint(res, Files[x].Size)
+	res = append(res, Files[x].SHA512[:]...)
+	res = appendUvarint(res, Files[x].Storage.NodeId)
+	res = appendUvarint(res, Files[x].Storage.NodePos)
+	res = appendUvarint(res, 0)
+	journal(J_FILE, res)
+	n := uint64(len(Nodes))
+	res = appendUvarint(make([]byte, 0), n)
+	res = appendUvarint(res, 3)
+	res = appendUvarint(res, 0)
+	res = append(res, make([]byte, 32)...)
+	res = appendUvarint(res, 0)
+	res = appendString(res, "0:zz|x")
+	journal(J_NODE, res)
+	FSMutex.Unlock()
+	reload()
+	if Files[x].Meta.Mode != 0 || string(readFile(t, "/dst/x")) != "xxxx" {
+		t.Fatal("short file record", Files[x])
+	}
+	if uint64(len(Nodes)) != n + 1 || mainSource(Nodes[n]) != "0:zz|x" || len(Nodes[n].Sources) != 1 || Nodes[n].Shards != nil {
+		t.Fatal("short node record", Nodes)
+	}
+}
+
+// The writer lock only reloads fs_data on the mount if it doesn't take away
+// what open files may point to.
+func TestLoadMore(t *testing.T) {
+	defer testFS(t, "local")()
+	writeTree(t, "src", map[string][]byte{"x": []byte("xxxx")})
+	copyPath("src", "/dst")
+	waitUploads()
+	save()
+	crashWriter()
+	if err := loadMore(); err != nil || string(readFile(t, "/dst/x")) != "xxxx" {
+		t.Fatal("reload", err)
+	}
+	os.Remove(FS_DATA_FILE)
+	os.Remove(JOURNAL_FILE)
+	if loadMore() == nil {
+		t.Fatal("reload of an emptied fs_data")
+	}
+}
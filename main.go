@@ -7,7 +7,7 @@ import (
 	_ "io"
 	"io/ioutil"
 	"sync"
-	"encoding/binary"
+	"crypto/sha256"
 	"crypto/sha512"
 	"strings"
 	"sort"
@@ -27,19 +27,65 @@ import (
 
 const MOUNT_POINT = "mnt"
 const FS_DATA_FILE = "fs_data"
+const FS_LOCK_FILE = "fs_data.lock"
+// changes since fs_data was saved, and the lock of the process making them
+const JOURNAL_FILE = "fs_data.journal"
+const WRITER_LOCK_FILE = "fs_data.wlock"
+const GC_PLAN_FILE = "gc_plan"
 const CACHE_PATH = "cache/"
 const TMP_PATH = "tmp/"
 const CACHE_LIMIT uint64 = 1099511627776
 const MIN_BLOCK_SIZE uint64 = 67108864
 const MAX_BLOCK_SIZE uint64 = 268435456 * 2
+// blocks smaller than this are always downloaded whole, bigger ones are read
+// by ranges until 1/RANGE_FILL_RATIO of them was requested
+const RANGE_MIN_BLOCK uint64 = 16777216
+const RANGE_FILL_RATIO uint64 = 8
+// the cache keeps and evicts blocks in chunks of this size, and background
+// fills download up to FILL_RUN_CHUNKS chunks per request
+const CACHE_CHUNK_SIZE uint64 = 1048576
+const FILL_RUN_CHUNKS uint64 = 64
+const CACHE_INDEX_FILE = CACHE_PATH + "index"
+const CACHE_INDEX_INTERVAL = 1 * time.Minute
+// a block whose hash doesn't match is downloaded again this many times before
+// it is marked bad
+const VERIFY_RETRIES = 3
+// repack rewrites packed blocks with less than this percentage of live bytes
+const REPACK_LIVE_PERCENT uint64 = 50
+// files written on the mount are staged here, and packed and uploaded
+// WRITE_DEBOUNCE after they are closed, or WRITE_OPEN_DEBOUNCE after the last
+// write if they stay open
+const WRITE_PATH = TMP_PATH + "w/"
+const WRITE_DEBOUNCE = 10 * time.Second
+const WRITE_OPEN_DEBOUNCE = 5 * time.Minute
 
 const NullId = 0xffffffffffffffff
 
+const BACKEND = "drive"
+// copies of each block to upload, on different accounts or backends
+const REPLICAS = 1
+// erasure coding of new blocks, as "data+parity" shards (see erasure.go),
+// instead of copies
+const EC = ""
+// blocks are encrypted with a key derived from the passphrase in this file,
+// if it exists
+const KEY_FILE = "seeefs_key"
+
+// Meta is the POSIX metadata of a file or dir, all zero if unknown.
+type Meta struct {
+	// st_mode, with the file type bits
+	Mode uint32
+	Uid, Gid uint32
+	// in ns since the epoch
+	Mtime, Ctime int64
+}
+
 type Dir struct {
 	Name string
 	Inode uint64
 	Child, Files []uint64
 	ChildMap, FilesMap map[string]uint64
+	Meta
 }
 
 type StorageInfo struct {
@@ -52,11 +98,27 @@ type File struct {
 	Inode, Size uint64
 	SHA512 [sha512.Size]byte
 	Storage StorageInfo
+	Meta
+	// target of symlinks, which have no storage
+	Link string
 }
 
 type Node struct {
 	Size uint64
-	Source string
+	// where the copies of the block are, none until it is uploaded
+	Sources []string
+	// erasure coded blocks have shards instead, DataShards data ones then
+	// the parity ones, "" for those missing
+	Shards []string
+	DataShards uint64
+	// SHA-256 of the block, all zeros for blocks made before it was recorded
+	Hash [sha256.Size]byte
+	Flags uint64
+	// random for each encrypted block, and authenticated with each of its
+	// segments so that they can't be swapped with those of another block
+	Salt [8]byte
+	// stored sizes of the segments of compressed blocks
+	Segments []uint64
 }
 
 var Dirs []Dir
@@ -64,121 +126,10 @@ var Files []File
 var Nodes []Node
 var Inodes uint64
 var SHA512Lookup map[[sha512.Size]byte]uint64
-var NodesOpenCnt []uint64
-var NodesLastAccess []uint64
-var NodesCached, NodesRealCached []bool
 var FSMutex sync.Mutex
 
-var CachedNodes []uint64
-var CacheListMutex sync.Mutex
-var CacheTotalSize uint64
-
-func realCache(id uint64) {
-	FSMutex.Lock()
-	src := Nodes[id].Source
-	sz := Nodes[id].Size
-	FSMutex.Unlock()
-	backend.CacheFile(src, CACHE_PATH + strconv.FormatUint(uint64(id), 10), sz)
-	FSMutex.Lock()
-	CacheListMutex.Lock()
-	NodesRealCached[id] = true
-	FSMutex.Unlock()
-	CacheListMutex.Unlock()
-}
-
-func cache(id uint64) {
-	//fmt.Println("cache", id, Nodes[id])
-	if !NodesCached[id] {
-		for CacheTotalSize > CACHE_LIMIT {
-			var oldest uint64 = NullId
-			pos := -1
-			for i := 0; i < len(CachedNodes); i++ {
-				if NodesOpenCnt[CachedNodes[i]] == 0 && NodesLastAccess[CachedNodes[i]] < oldest {
-					oldest = NodesLastAccess[CachedNodes[i]]
-					pos = i
-				}
-			}
-			if pos == -1 {
-				break
-			}
-			if pos != len(CachedNodes) - 1 {
-				CachedNodes[pos], CachedNodes[len(CachedNodes) - 1] = CachedNodes[len(CachedNodes) - 1], CachedNodes[pos]
-			}
-			rid := CachedNodes[len(CachedNodes) - 1]
-			CachedNodes = CachedNodes[:len(CachedNodes) - 1]
-			NodesCached[rid] = false
-			NodesRealCached[rid] = false
-			os.Remove(CACHE_PATH + strconv.FormatUint(uint64(rid), 10))
-			CacheTotalSize -= Nodes[rid].Size
-			//fmt.Println("/remove node", rid)
-		}
-		NodesCached[id] = true
-		go realCache(id)
-		CachedNodes = append(CachedNodes, id)
-		CacheTotalSize += Nodes[id].Size
-		//fmt.Println("/cache node", id)
-	}
-	NodesLastAccess[id] = uint64(time.Now().UnixNano() / int64(time.Millisecond))
-}
-
-func preCache(id uint64) {
-	FSMutex.Lock()
-	CacheListMutex.Lock()
-	cache(id)
-	FSMutex.Unlock()
-	CacheListMutex.Unlock()
-}
-
-func getNodeFile(id uint64) *os.File {
-	//fmt.Println("open node", id)
-	FSMutex.Lock()
-	CacheListMutex.Lock()
-	cache(id)
-	NodesOpenCnt[id]++
-	flag := NodesRealCached[id]
-	FSMutex.Unlock()
-	CacheListMutex.Unlock()
-	if !flag {
-		for true {
-			FSMutex.Lock()
-			CacheListMutex.Lock()
-			flag = NodesRealCached[id]
-			FSMutex.Unlock()
-			CacheListMutex.Unlock()
-			if flag {
-				break
-			}
-			time.Sleep(20 * time.Millisecond)
-		}
-	}
-	f, err := os.Open(CACHE_PATH + strconv.FormatUint(uint64(id), 10))
-	if err != nil {
-		log.Fatal(err)
-	}
-	return f
-}
-
-func closeNodeFile(id uint64, f *os.File) {
-	//fmt.Println("close node", id)
-	f.Close()
-	FSMutex.Lock()
-	CacheListMutex.Lock()
-	NodesOpenCnt[id]--
-	FSMutex.Unlock()
-	CacheListMutex.Unlock()
-}
-
-func preFetch(id uint64) {
-	var nid uint64
-	FSMutex.Lock()
-	if len(Files[id].Storage.Nodes) > 0 {
-		nid = Files[id].Storage.Nodes[0]
-	} else {
-		nid = Files[id].Storage.NodeId
-	}
-	FSMutex.Unlock()
-	go preCache(nid)
-}
+var Remote backend.Backend
+var Replicas int
 
 type FuseDir struct {
 	Id uint64
@@ -193,6 +144,36 @@ type FuseFileHandle struct {
 	Size, Cur uint64
 	NodesSize []uint64
 	File *os.File
+	// set for files being written, which are read from their staged copy
+	Id uint64
+	Dirty *dirtyFile
+	// opened for writing, the file is only staged on the first write
+	Writable bool
+	mutex sync.Mutex
+}
+
+func newFileHandle(id uint64) *FuseFileHandle {
+	FSMutex.Lock()
+	res := FuseFileHandle{Storage: Files[id].Storage, Size: Files[id].Size, Cur: NullId, Id: id}
+	res.NodesSize = make([]uint64, len(res.Storage.Nodes))
+	for i := 0; i < len(res.Storage.Nodes); i++ {
+		res.NodesSize[i] = Nodes[res.Storage.Nodes[i]].Size
+	}
+	FSMutex.Unlock()
+	return &res
+}
+
+func (f *FuseFileHandle) close() {
+	if f.Cur != NullId {
+		closeNodeFile(f.Cur, f.File)
+		f.Cur = NullId
+	}
+	f.mutex.Lock()
+	if f.Dirty != nil {
+		f.Dirty.release()
+		f.Dirty = nil
+	}
+	f.mutex.Unlock()
 }
 
 func (f *FuseFileHandle) switchFile(id uint64) {
@@ -203,13 +184,25 @@ func (f *FuseFileHandle) switchFile(id uint64) {
 		closeNodeFile(f.Cur, f.File)
 	}
 	f.File = getNodeFile(id)
-	if id + 1 < uint64(len(f.Storage.Nodes)) {
-		preCache(f.Storage.Nodes[id + 1])
-	}
 	f.Cur = id
 }
 
-func (f *FuseFileHandle) readBytes(l, r uint64) []byte {
+func (f *FuseFileHandle) readNode(id, off, n uint64) ([]byte, error) {
+	f.switchFile(id)
+	noteRead(id, n)
+	err := fetchChunks(id, off / CACHE_CHUNK_SIZE, (off + n - 1) / CACHE_CHUNK_SIZE + 1, backend.PRIO_READ)
+	if err != nil {
+		return nil, err
+	}
+	buf := make([]byte, n)
+	_, err = f.File.ReadAt(buf, int64(off))
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (f *FuseFileHandle) readBytes(l, r uint64) ([]byte, error) {
 	if l < 0 {
 		l = 0
 	}
@@ -217,15 +210,11 @@ func (f *FuseFileHandle) readBytes(l, r uint64) []byte {
 		r = f.Size
 	}
 	if l >= r {
-		return make([]byte, 0)
+		return make([]byte, 0), nil
 	}
 	if len(f.Storage.Nodes) == 0 {
-		f.switchFile(f.Storage.NodeId)
 		//fmt.Println("switch", f.Storage.NodeId)
-		f.File.Seek(int64(l + f.Storage.NodePos), 0)
-		buf := make([]byte, r - l)
-		f.File.Read(buf)
-		return buf
+		return f.readNode(f.Storage.NodeId, l + f.Storage.NodePos, r - l)
 	}
 	var ul, ur, tl, tr uint64
 	res := make([]byte, 0)
@@ -235,17 +224,17 @@ func (f *FuseFileHandle) readBytes(l, r uint64) []byte {
 		if ul > tl { tl = ul }
 		if ur < tr { tr = ur }
 		if tl < tr {
-			f.switchFile(f.Storage.Nodes[i])
 			//fmt.Println("switch big", f.Storage.NodeId)
-			f.File.Seek(int64(tl - ul), 0)
-			buf := make([]byte, tr - tl)
-			f.File.Read(buf)
+			buf, err := f.readNode(f.Storage.Nodes[i], tl - ul, tr - tl)
+			if err != nil {
+				return nil, err
+			}
 			res = append(res, buf...)
 		}
 		ul = ur
 	}
 	//fmt.Println("read big", l, r, len(res))
-	return res
+	return res, nil
 }
 
 func addChild(x uint64, name string) uint64 {
@@ -261,9 +250,16 @@ func addChild(x uint64, name string) uint64 {
 	Dirs[n].Files = make([]uint64, 0)
 	Dirs[n].ChildMap = make(map[string]uint64, 0)
 	Dirs[n].FilesMap = make(map[string]uint64, 0)
+	journalDir(x, n)
 	return n
 }
 
+// noStorage is the storage of files without blocks: created on the mount
+// and not committed yet, or symlinks.
+func noStorage() StorageInfo {
+	return StorageInfo{NullId, 0, make([]uint64, 0)}
+}
+
 func addChildFile(x uint64, name string) uint64 {
 	n := uint64(len(Files))
 	Files = append(Files, File{})
@@ -272,10 +268,73 @@ func addChildFile(x uint64, name string) uint64 {
 	Files[n].Name = name
 	Inodes++
 	Files[n].Inode = Inodes
-	Files[n].Storage.Nodes = make([]uint64, 0)
+	Files[n].Storage = noStorage()
+	journalNewFile(x, n)
 	return n
 }
 
+func removeId(s []uint64, id uint64) []uint64 {
+	for i := 0; i < len(s); i++ {
+		if s[i] == id {
+			return append(s[:i], s[i + 1:]...)
+		}
+	}
+	return s
+}
+
+// unlinkChild takes dir n out of dir x, it is kept in Dirs unreachable.
+func unlinkChild(x, n uint64) {
+	Dirs[x].Child = removeId(Dirs[x].Child, n)
+	delete(Dirs[x].ChildMap, Dirs[n].Name)
+}
+
+func unlinkChildFile(x, n uint64) {
+	Dirs[x].Files = removeId(Dirs[x].Files, n)
+	delete(Dirs[x].FilesMap, Files[n].Name)
+}
+
+func linkChild(x, n uint64, name string) {
+	Dirs[n].Name = name
+	Dirs[x].Child = append(Dirs[x].Child, n)
+	Dirs[x].ChildMap[name] = n
+}
+
+func linkChildFile(x, n uint64, name string) {
+	Files[n].Name = name
+	Dirs[x].Files = append(Dirs[x].Files, n)
+	Dirs[x].FilesMap[name] = n
+}
+
+// removeFile unlinks file n from dir x and leaves it in Files as a tombstone,
+// with an empty name.
+func removeFile(x, n uint64) {
+	unlinkChildFile(x, n)
+	Files[n].Name = ""
+	dropLookup(n)
+}
+
+// dropLookup is called when file n is removed or its content changes. If
+// SHA512Lookup leads to it, it is pointed to another live file with the same
+// content instead, or dropped if there is none.
+func dropLookup(n uint64) {
+	h := Files[n].SHA512
+	if rid, ok := SHA512Lookup[h]; !ok || rid != n {
+		return
+	}
+	delete(SHA512Lookup, h)
+	for i := 0; i < len(Files); i++ {
+		if uint64(i) != n && Files[i].Name != "" && Files[i].SHA512 == h {
+			SHA512Lookup[h] = uint64(i)
+			return
+		}
+	}
+}
+
+func removeDir(x, n uint64) {
+	unlinkChild(x, n)
+	Dirs[n].Name = ""
+}
+
 func clear() {
 	Dirs = make([]Dir, 1)
 	Files = make([]File, 0)
@@ -287,151 +346,70 @@ func clear() {
 	Dirs[0].ChildMap = make(map[string]uint64, 0)
 	Dirs[0].FilesMap = make(map[string]uint64, 0)
 	Inodes = 1
-	NodesOpenCnt = make([]uint64, 0)
-	NodesLastAccess = make([]uint64, 0)
+	resizeNodeState(0)
 	SHA512Lookup = make(map[[sha512.Size]byte]uint64)
 }
 
-func appendUvarint(s []byte, x uint64) []byte {
-	n := len(s)
-	s = append(s, make([]byte, binary.MaxVarintLen64)...)
-	n += binary.PutUvarint(s[n:], x)
-	return s[:n]
-}
-
-func getUvarint(s []byte) (uint64, uint) {
-	a, b := binary.Uvarint(s)
-	return a, uint(b)
-}
-
-func saveBytes() []byte {
-	res := make([]byte, 0)
-	res = appendUvarint(res, uint64(len(Dirs)))
-	for i := 0; i < len(Dirs); i++ {
-		ts := []rune(Dirs[i].Name)
-		res = appendUvarint(res, uint64(len(ts)))
-		for j := 0; j < len(ts); j++ {
-			res = appendUvarint(res, uint64(ts[j]))
-		}
-		res = appendUvarint(res, uint64(Dirs[i].Inode))
-		res = appendUvarint(res, uint64(len(Dirs[i].Child)))
-		for j := 0; j < len(Dirs[i].Child); j++ {
-			res = appendUvarint(res, uint64(Dirs[i].Child[j]))
-		}
-		res = appendUvarint(res, uint64(len(Dirs[i].Files)))
-		for j := 0; j < len(Dirs[i].Files); j++ {
-			res = appendUvarint(res, uint64(Dirs[i].Files[j]))
-		}
+// writeFSData replaces fs_data with t, so that a crash leaves either the old
+// or the new one.
+func writeFSData(t []byte) {
+	tmp := FS_DATA_FILE + ".tmp"
+	f, err := os.Create(tmp)
+	if err != nil {
+		log.Fatal(err)
 	}
-	res = appendUvarint(res, uint64(len(Files)))
-	for i := 0; i < len(Files); i++ {
-		ts := []rune(Files[i].Name)
-		res = appendUvarint(res, uint64(len(ts)))
-		for j := 0; j < len(ts); j++ {
-			res = appendUvarint(res, uint64(ts[j]))
-		}
-		res = appendUvarint(res, uint64(Files[i].Inode))
-		res = appendUvarint(res, uint64(Files[i].Size))
-		res = appendUvarint(res, uint64(Files[i].Storage.NodeId))
-		res = appendUvarint(res, uint64(Files[i].Storage.NodePos))
-		res = append(res, Files[i].SHA512[:]...)
-		//fmt.Println(len(res))
-		res = appendUvarint(res, uint64(len(Files[i].Storage.Nodes)))
-		for j := 0; j < len(Files[i].Storage.Nodes); j++ {
-			res = appendUvarint(res, uint64(Files[i].Storage.Nodes[j]))
-		}
+	_, err = f.Write(t)
+	if err == nil {
+		err = f.Sync()
 	}
-	res = appendUvarint(res, uint64(len(Nodes)))
-	for i := 0; i < len(Nodes); i++ {
-		res = appendUvarint(res, uint64(Nodes[i].Size))
-		ts := []rune(Nodes[i].Source)
-		res = appendUvarint(res, uint64(len(ts)))
-		for j := 0; j < len(ts); j++ {
-			res = appendUvarint(res, uint64(ts[j]))
-		}
+	f.Close()
+	if err == nil {
+		err = os.Rename(tmp, FS_DATA_FILE)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+	d, err := os.Open(".")
+	if err == nil {
+		d.Sync()
+		d.Close()
 	}
-	res = appendUvarint(res, Inodes)
-	return res
 }
 
+// save writes fs_data, and empties the journal if nothing was added to it
+// meanwhile.
 func save() {
+	SaveMutex.Lock()
+	defer SaveMutex.Unlock()
+	FSMutex.Lock()
+	JournalMutex.Lock()
+	seq := JournalSeq
 	t := saveBytes()
-	f, err := os.Create(FS_DATA_FILE)
-	if err != nil {
-		log.Fatal(err)
-		return
-	}
-	f.Write(t)
-	f.Close()
+	JournalMutex.Unlock()
+	FSMutex.Unlock()
+	writeFSData(t)
+	resetJournal(seq)
 }
 
-func loadBytes(s []byte) {
+// loadBytes replaces the filesystem with the one in fs_data s.
+func loadBytes(s []byte) error {
+	st, err := decodeState(s)
+	if err != nil {
+		return err
+	}
 	FSMutex.Lock()
 	CacheListMutex.Lock()
-	var a uint64
-	var n, b uint
-	a, b = getUvarint(s[n:]); n += b
-	Dirs = make([]Dir, uint(a))
-	for i := 0; i < len(Dirs); i++ {
-		a, b = getUvarint(s[n:]); n += b
-		ts := make([]rune, uint(a))
-		for j := 0; j < len(ts); j++ {
-			a, b = getUvarint(s[n:]); n += b
-			ts[j] = rune(a)
-		}
-		Dirs[i].Name = string(ts)
-		Dirs[i].Inode, b = getUvarint(s[n:]); n += b
-		a, b = getUvarint(s[n:]); n += b
-		Dirs[i].Child = make([]uint64, uint(a))
-		for j := 0; j < len(Dirs[i].Child); j++ {
-			Dirs[i].Child[j], b = getUvarint(s[n:]); n += b
-		}
-		a, b = getUvarint(s[n:]); n += b
-		Dirs[i].Files = make([]uint64, uint(a))
-		for j := 0; j < len(Dirs[i].Files); j++ {
-			Dirs[i].Files[j], b = getUvarint(s[n:]); n += b
-		}
-	}
+	Dirs = st.Dirs
+	Files = st.Files
+	Nodes = st.Nodes
+	Inodes = st.Inodes
+	CryptSalt = st.Salt
 	SHA512Lookup = make(map[[sha512.Size]byte]uint64)
-	a, b = getUvarint(s[n:]); n += b
-	Files = make([]File, uint(a))
 	for i := 0; i < len(Files); i++ {
-		a, b = getUvarint(s[n:]); n += b
-		ts := make([]rune, uint(a))
-		for j := 0; j < len(ts); j++ {
-			a, b = getUvarint(s[n:]); n += b
-			ts[j] = rune(a)
-		}
-		Files[i].Name = string(ts)
-		Files[i].Inode, b = getUvarint(s[n:]); n += b
-		Files[i].Size, b = getUvarint(s[n:]); n += b
-		Files[i].Storage.NodeId, b = getUvarint(s[n:]); n += b
-		Files[i].Storage.NodePos, b = getUvarint(s[n:]); n += b
-		copy(Files[i].SHA512[:], s[n: n + sha512.Size])
-		n += sha512.Size
-		//fmt.Println(n, len(s))
-		a, b = getUvarint(s[n:]); n += b
-		Files[i].Storage.Nodes = make([]uint64, uint(a))
-		for j := 0; j < len(Files[i].Storage.Nodes); j++ {
-			Files[i].Storage.Nodes[j], b = getUvarint(s[n:]); n += b
+		// removed files are kept as tombstones without a name
+		if Files[i].Name != "" {
+			SHA512Lookup[Files[i].SHA512] = uint64(i)
 		}
-		SHA512Lookup[Files[i].SHA512] = uint64(i)
-	}
-	a, b = getUvarint(s[n:]); n += b
-	Nodes = make([]Node, uint(a))
-	for i := 0; i < len(Nodes); i++ {
-		Nodes[i].Size, b = getUvarint(s[n:]); n += b
-		a, b = getUvarint(s[n:]); n += b
-		ts := make([]rune, uint(a))
-		for j := 0; j < len(ts); j++ {
-			a, b = getUvarint(s[n:]); n += b
-			ts[j] = rune(a)
-		}
-		Nodes[i].Source = string(ts)
-	}
-	Inodes, b = getUvarint(s[n:]); n += b
-	if int(n) != len(s) {
-		log.Fatal("fs data decode error")
 	}
 	for i := 0; i < len(Dirs); i++ {
 		Dirs[i].ChildMap = make(map[string]uint64, 0)
@@ -443,28 +421,13 @@ func loadBytes(s []byte) {
 			Dirs[i].FilesMap[Files[Dirs[i].Files[j]].Name] = Dirs[i].Files[j]
 		}
 	}
-	t := make([]uint64, len(Nodes))
-	if NodesOpenCnt != nil {
-		copy(t, NodesOpenCnt)
-	}
-	NodesOpenCnt = t
-	t = make([]uint64, len(Nodes))
-	if NodesLastAccess != nil {
-		copy(t, NodesLastAccess)
-	}
-	NodesLastAccess = t
-	t2 := make([]bool, len(Nodes))
-	if NodesCached != nil {
-		copy(t2, NodesCached)
-	}
-	NodesCached = t2
-	t3 := make([]bool, len(Nodes))
-	if NodesRealCached != nil {
-		copy(t3, NodesRealCached)
-	}
-	NodesRealCached = t3
-	FSMutex.Unlock()
+	JournalMutex.Lock()
+	JournalSeq = st.Seq
+	JournalMutex.Unlock()
+	resizeNodeState(len(Nodes))
 	CacheListMutex.Unlock()
+	FSMutex.Unlock()
+	return nil
 }
 
 func load() {
@@ -472,11 +435,20 @@ func load() {
 	if err != nil {
 		log.Print(err)
 		clear()
-		return
+		JournalMutex.Lock()
+		JournalSeq = 0
+		JournalMutex.Unlock()
+	} else {
+		t, err := ioutil.ReadAll(f)
+		f.Close()
+		if err == nil {
+			err = loadBytes(t)
+		}
+		if err != nil {
+			log.Fatal("fs data decode error: ", err)
+		}
 	}
-	t, _ := ioutil.ReadAll(f)
-	f.Close()
-	loadBytes(t)
+	replayJournal()
 }
 
 func getChild(id uint64, name string) uint64 {
@@ -540,13 +512,15 @@ func getNewPath(path string) uint64 {
 }
 
 func isDir(path string) bool {
-	s, err := os.Stat(path)
+	s, err := os.Lstat(path)
 	if err != nil {
 		return false
 	}
 	return s.IsDir()
 }
 
+// checkExists tells if copying path to dir id would replace something. Files
+// already there with the same size are taken as copied by an interrupted copy.
 func checkExists(id uint64, path string) bool {
 	//path[-1] should be /
 	files, err := ioutil.ReadDir(path)
@@ -556,8 +530,12 @@ func checkExists(id uint64, path string) bool {
 	}
 	for _, f := range files {
 		fn := f.Name()
-		if getChildFile(id, fn) != NullId {
-			return true
+		if t := getChildFile(id, fn); t != NullId {
+			fs, err := os.Lstat(path + fn)
+			if err != nil || fs.IsDir() || uint64(fs.Size()) != Files[t].Size {
+				return true
+			}
+			continue
 		}
 		t := getChild(id, fn)
 		if t != NullId {
@@ -596,16 +574,84 @@ func linkExistsFile(id uint64) bool {
 	if rid, ok := SHA512Lookup[Files[id].SHA512]; ok {
 		Files[id].Storage = Files[rid].Storage
 		Files[id].Inode = Files[rid].Inode
+		Files[id].Size = Files[rid].Size
 		return true
 	}
 	return false
 }
 
+// appendNode adds node to Nodes and returns its id.
+func appendNode(node Node) uint64 {
+	if node.Flags & NODE_ENCRYPTED != 0 {
+		node.Salt = newNodeSalt()
+	}
+	FSMutex.Lock()
+	CacheListMutex.Lock()
+	n := uint64(len(Nodes))
+	Nodes = append(Nodes, node)
+	resizeNodeState(len(Nodes))
+	CacheListMutex.Unlock()
+	journalNode(n)
+	FSMutex.Unlock()
+	return n
+}
+
+// startUpload uploads node i in the background.
+func startUpload(i uint64) {
+	FSMutex.Lock()
+	Uploading++
+	FSMutex.Unlock()
+	go uploadNode(i)
+}
+
+// uploadNode uploads the tmp file of node i. Reads of the node are served
+// from the tmp file until it is uploaded, and it is removed once the source
+// is in the journal.
 func uploadNode(i uint64) {
-	t := backend.MoveFile(TMP_PATH + strconv.FormatUint(i, 10), strconv.FormatUint(i, 10))
+	tmp := TMP_PATH + strconv.FormatUint(i, 10)
+	src := tmp
+	FSMutex.Lock()
+	flags := Nodes[i].Flags
+	salt := Nodes[i].Salt
+	FSMutex.Unlock()
+	if flags & NODE_ENCRYPTED != 0 {
+		src = tmp + ".enc"
+		err := encryptFile(tmp, src, salt)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	var t, shards []string
+	var k uint64
+	if ECData > 0 {
+		k, shards = uploadShards(i, src)
+	}
+	if shards == nil {
+		t = backend.UploadReplicas(Remote, src, strconv.FormatUint(i, 10), Replicas, nil)
+	}
+	if src != tmp {
+		os.Remove(src)
+	}
 	FSMutex.Lock()
-	Nodes[i].Source = t
+	Nodes[i].Sources = t
+	Nodes[i].Shards = shards
+	Nodes[i].DataShards = k
+	journalNode(i)
+	Uploading--
 	FSMutex.Unlock()
+	os.Remove(tmp)
+}
+
+func waitUploads() {
+	for true {
+		FSMutex.Lock()
+		n := Uploading
+		FSMutex.Unlock()
+		if n == 0 {
+			break
+		}
+		time.Sleep(2 * time.Second)
+	}
 }
 
 func sha512OfFile(path string, size uint64) (res [sha512.Size]byte, err error) {
@@ -635,23 +681,24 @@ func sha512OfFile(path string, size uint64) (res [sha512.Size]byte, err error) {
 
 func makeBigFile(id, size uint64, path string, skipLink bool) {
 	fmt.Println("makeBigFile", id, size, path)
-	var err error
-	Files[id].SHA512, err = sha512OfFile(path, size)
+	hash, err := sha512OfFile(path, size)
 	if err != nil {
 		log.Fatal(err)
 	}
+	FSMutex.Lock()
+	Files[id].SHA512 = hash
 	if !skipLink && linkExistsFile(id) {
+		journalFile(id)
+		FSMutex.Unlock()
 		return
 	}
-	SHA512Lookup[Files[id].SHA512] = id
+	FSMutex.Unlock()
 	f, err := os.Open(path)
 	if err != nil {
 		log.Fatal(err)
 		return
 	}
-	Files[id].Storage.NodeId = 0
-	Files[id].Storage.NodePos = 0
-	Files[id].Storage.Nodes = make([]uint64, 0)
+	storage := StorageInfo{0, 0, make([]uint64, 0)}
 	bc := int((size + MAX_BLOCK_SIZE - 1) / MAX_BLOCK_SIZE)
 	var pos uint64 = 0
 	for i := 0; i < bc; i++ {
@@ -660,7 +707,7 @@ func makeBigFile(id, size uint64, path string, skipLink bool) {
 		buf := make([]byte, int(bs))
 		f.Read(buf)
 		pos += bs
-		n := uint64(len(Nodes))
+		n := appendNode(Node{Size: bs, Hash: sha256.Sum256(buf), Flags: newNodeFlags()})
 		path := TMP_PATH + strconv.FormatUint(n, 10)
 		//fmt.Println(path)
 		f, err := os.Create(path)
@@ -670,17 +717,20 @@ func makeBigFile(id, size uint64, path string, skipLink bool) {
 		}
 		f.Write(buf)
 		f.Close()
-		FSMutex.Lock()
-		Nodes = append(Nodes, Node{bs, ""})
-		FSMutex.Unlock()
-		go uploadNode(n)
-		Files[id].Storage.Nodes = append(Files[id].Storage.Nodes, n)
+		startUpload(n)
+		storage.Nodes = append(storage.Nodes, n)
 	}
 	if bc == 1 {
-		Files[id].Storage.NodeId = Files[id].Storage.Nodes[0]
-		Files[id].Storage.Nodes = make([]uint64, 0)
+		storage.NodeId = storage.Nodes[0]
+		storage.Nodes = make([]uint64, 0)
 	}
 	f.Close()
+	FSMutex.Lock()
+	Files[id].Storage = storage
+	Files[id].Size = size
+	SHA512Lookup[hash] = id
+	journalFile(id)
+	FSMutex.Unlock()
 }
 
 func makeFiles(s []NewFile, force, skipLink bool) []NewFile {
@@ -699,15 +749,24 @@ func makeFiles(s []NewFile, force, skipLink bool) []NewFile {
 		}
 		t, _ := ioutil.ReadAll(f)
 		f.Close()
+		FSMutex.Lock()
 		Files[s[i].Id].SHA512 = sha512.Sum512(t)
 		//fmt.Println(Files[s[i].Id].SHA512)
 		if skipLink || !linkExistsFile(s[i].Id) {
 			buf = append(buf, t...)
 			pending = append(pending, s[i])
+		} else {
+			journalFile(s[i].Id)
 		}
+		FSMutex.Unlock()
 		if uint64(len(buf)) >= MIN_BLOCK_SIZE || (i == len(s) - 1 && force && len(pending) > 0) {
 			fmt.Println("block ok")
-			n := uint64(len(Nodes))
+			stored, segs := compressBlock(buf)
+			flags := newNodeFlags()
+			if segs != nil {
+				flags |= NODE_COMPRESSED
+			}
+			n := appendNode(Node{Size: uint64(len(buf)), Hash: sha256.Sum256(buf), Flags: flags, Segments: segs})
 			path := TMP_PATH + strconv.FormatUint(n, 10)
 			//fmt.Println(path)
 			f, err := os.Create(path)
@@ -715,19 +774,19 @@ func makeFiles(s []NewFile, force, skipLink bool) []NewFile {
 				log.Fatal(err)
 				return s
 			}
-			f.Write(buf)
+			f.Write(stored)
 			f.Close()
 			var pos uint64 = 0
+			FSMutex.Lock()
 			for j := 0; j < len(pending); j++ {
-				Files[pending[j].Id].Storage.NodeId = n
-				Files[pending[j].Id].Storage.NodePos = pos
+				Files[pending[j].Id].Storage = StorageInfo{n, pos, make([]uint64, 0)}
+				Files[pending[j].Id].Size = pending[j].Size
 				pos += pending[j].Size
 				SHA512Lookup[Files[pending[j].Id].SHA512] = pending[j].Id
+				journalFile(pending[j].Id)
 			}
-			FSMutex.Lock()
-			Nodes = append(Nodes, Node{uint64(len(buf)), ""})
 			FSMutex.Unlock()
-			go uploadNode(n)
+			startUpload(n)
 			buf = make([]byte, 0)
 			pending = make([]NewFile, 0)
 		}
@@ -748,14 +807,24 @@ func getNewFiles(id uint64, path string) []NewFile {
 			t := getChild(id, fn)
 			if t == NullId {
 				t = addChild(id, fn)
+				setDirMeta(t, statMeta(f))
 			}
 			res = append(res, getNewFiles(t, path + fn + "/")...)
 		} else {
+			if getChildFile(id, fn) != NullId {
+				fmt.Println("already copied:", path + fn)
+				continue
+			}
 			t := addChildFile(id, fn)
+			if f.Mode() & os.ModeSymlink != 0 {
+				makeLink(t, path + fn, f)
+				continue
+			}
 			fs, err := os.Stat(path + fn)
 			if err == nil {
 				sz := uint64(fs.Size())
 				Files[t].Size = sz
+				Files[t].Meta = statMeta(fs)
 				if sz >= MIN_BLOCK_SIZE {
 					makeBigFile(t, sz, path + fn, false)
 				} else {
@@ -770,22 +839,47 @@ func getNewFiles(id uint64, path string) []NewFile {
 	return makeFiles(res, false, false)
 }
 
+// fileNodes returns the nodes holding file i.
+func fileNodes(i uint64) []uint64 {
+	if Files[i].Link != "" {
+		return nil
+	}
+	if len(Files[i].Storage.Nodes) == 0 {
+		if Files[i].Storage.NodeId == NullId {
+			return nil
+		}
+		return []uint64{Files[i].Storage.NodeId}
+	}
+	return Files[i].Storage.Nodes
+}
+
+// liveFiles returns the files which can be reached from dir x.
+func liveFiles(x uint64) []uint64 {
+	res := append([]uint64{}, Dirs[x].Files...)
+	for _, c := range Dirs[x].Child {
+		res = append(res, liveFiles(c)...)
+	}
+	return res
+}
+
+// nodeRefs counts the live files using each node.
+func nodeRefs() []int {
+	res := make([]int, len(Nodes))
+	for _, i := range liveFiles(0) {
+		for _, n := range fileNodes(i) {
+			res[n]++
+		}
+	}
+	return res
+}
+
 func checkUploaded(st int, pr bool) bool {
 	FSMutex.Lock()
 	if pr { fmt.Println(len(Nodes)) }
-	nodeUsed := make([]int, len(Nodes))
-	for i := 0; i < len(Files); i++ {
-		if len(Files[i].Storage.Nodes) == 0 {
-			nodeUsed[Files[i].Storage.NodeId]++
-		} else {
-			for j := 0; j < len(Files[i].Storage.Nodes); j++ {
-				nodeUsed[Files[i].Storage.Nodes[j]]++
-			}
-		}
-	}
+	nodeUsed := nodeRefs()
 	res := true
 	for i := st; i < len(Nodes); i++ {
-		if Nodes[i].Source == "" {
+		if !uploaded(Nodes[i]) {
 			if pr { fmt.Println(i, Nodes[i], nodeUsed[i]) }
 			if nodeUsed[i] > 0 { res = false }
 		}
@@ -822,7 +916,7 @@ func copyPath(src, dst string) {
 	fl := getNewFiles(dst_id, src + "/")
 	makeFiles(fl, true, false)
 	/*for i := old_node; i < len(Nodes); i++ {
-		Nodes[i].Source = backend.MoveFile(TMP_PATH + strconv.FormatUint(uint64(i), 10), strconv.FormatUint(uint64(i), 10))
+		Nodes[i].Source = backend.MoveFile(Remote, TMP_PATH + strconv.FormatUint(uint64(i), 10), strconv.FormatUint(uint64(i), 10))
 	}*/
 	//backend.WaitAll()
 	//time.Sleep(1 * time.Second) // to let fileid write back
@@ -846,18 +940,26 @@ func dfsCheck(a, b string, id uint64) []NewFile {
 			t := getChild(id, fn)
 			if t == NullId {
 				t = addChild(id, fn)
+				setDirMeta(t, statMeta(f))
 				res = append(res, getNewFiles(t, b + "/" + fn + "/")...)
 			} else {
 				res = append(res, dfsCheck(a + "/" + fn, b + "/" + fn, t)...)
 			}
 		} else {
 			t := getChildFile(id, fn)
+			if f.Mode() & os.ModeSymlink != 0 {
+				if t == NullId {
+					t = addChildFile(id, fn)
+				}
+				makeLink(t, b + "/" + fn, f)
+				continue
+			}
 			fs, _ := os.Stat(b + "/" + fn)
 			sz := uint64(fs.Size())
 			flag := false
 			if t == NullId {
 				flag = true
-				t := addChildFile(id, fn)
+				t = addChildFile(id, fn)
 				Files[t].Size = sz
 			} else {
 				bh, _ := sha512OfFile(b + "/" + fn, sz)
@@ -871,6 +973,10 @@ func dfsCheck(a, b string, id uint64) []NewFile {
 			}
 			if flag {
 				fmt.Println("hash differs:", a, b, fn)
+				FSMutex.Lock()
+				Files[t].Meta = statMeta(fs)
+				Files[t].Link = ""
+				FSMutex.Unlock()
 				if sz >= MIN_BLOCK_SIZE {
 					makeBigFile(t, sz, b + "/" + fn, true)
 				} else {
@@ -910,7 +1016,7 @@ func checkPath(src, dst string) {
 	fmt.Println(s)
 	makeFiles(s, true, true)
 	//time.Sleep(1 * time.Second) // to let it start upload
-	backend.WaitAll()
+	Remote.Wait()
 	fmt.Println("waitall ok")
 	//time.Sleep(1 * time.Second) // to let fileid write back
 	for true {
@@ -928,16 +1034,22 @@ func (FuseFS) Root() (fusefs.Node, error) {
 func (f FuseDir) Attr(ctx context.Context, a *fuse.Attr) error {
 	FSMutex.Lock()
 	a.Inode = Dirs[f.Id].Inode
+	Dirs[f.Id].Meta.attr(a, os.ModeDir, 0755)
 	FSMutex.Unlock()
-	a.Mode = os.ModeDir | 0555
 	return nil
 }
 
 func (f FuseDir) Lookup(ctx context.Context, name string) (fusefs.Node, error) {
 	if f.Id == 0 && name == "__refresh__" {
-		log.Print("reload")
-		load()
-		backend.Load()
+		if Writer {
+			log.Print("reload refused, the mount has changed fs_data")
+		} else {
+			log.Print("reload")
+			if err := loadMore(); err != nil {
+				log.Fatal(err)
+			}
+			Remote.Load()
+		}
 	}
 	FSMutex.Lock()
 	if val, ok := Dirs[f.Id].ChildMap[name]; ok {
@@ -957,11 +1069,15 @@ func (f FuseDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 	res := make([]fuse.Dirent, 0)
 	for i := 0; i < len(Dirs[f.Id].Child); i++ {
 		ti := Dirs[f.Id].Child[i]
-		res = append(res, fuse.Dirent{Inode: Dirs[ti].Inode, Name: Dirs[ti].Name, Type: fuse.DT_File})
+		res = append(res, fuse.Dirent{Inode: Dirs[ti].Inode, Name: Dirs[ti].Name, Type: fuse.DT_Dir})
 	}
 	for i := 0; i < len(Dirs[f.Id].Files); i++ {
 		ti := Dirs[f.Id].Files[i]
-		res = append(res, fuse.Dirent{Inode: Files[ti].Inode, Name: Files[ti].Name, Type: fuse.DT_File})
+		typ := fuse.DT_File
+		if Files[ti].Link != "" {
+			typ = fuse.DT_Link
+		}
+		res = append(res, fuse.Dirent{Inode: Files[ti].Inode, Name: Files[ti].Name, Type: typ})
 	}
 	FSMutex.Unlock()
 	return res, nil
@@ -970,37 +1086,73 @@ func (f FuseDir) ReadDirAll(ctx context.Context) ([]fuse.Dirent, error) {
 func (f FuseFile) Attr(ctx context.Context, a *fuse.Attr) error {
 	FSMutex.Lock()
 	a.Inode = Files[f.Id].Inode
-	a.Mode = 0444
+	if Files[f.Id].Link != "" {
+		Files[f.Id].Meta.attr(a, os.ModeSymlink, 0777)
+	} else {
+		Files[f.Id].Meta.attr(a, 0, 0644)
+	}
 	a.Size = Files[f.Id].Size
 	FSMutex.Unlock()
+	DirtyMutex.Lock()
+	if d, ok := DirtyFiles[f.Id]; ok {
+		a.Size = d.Size
+		a.Mtime = d.Mtime
+		a.Atime = d.Mtime
+	}
+	DirtyMutex.Unlock()
 	return nil
 }
 
 func (f FuseFile) Open(ctx context.Context, req *fuse.OpenRequest, resp *fuse.OpenResponse) (fh fusefs.Handle, err error) {
-	preFetch(f.Id)
-	FSMutex.Lock()
-	res := FuseFileHandle{Storage: Files[f.Id].Storage, Size: Files[f.Id].Size, Cur: NullId}
-	res.NodesSize = make([]uint64, len(res.Storage.Nodes))
-	for i := 0; i < len(res.Storage.Nodes); i++ {
-		res.NodesSize[i] = Nodes[res.Storage.Nodes[i]].Size
+	var d *dirtyFile
+	rw := !req.Flags.IsReadOnly()
+	if rw {
+		if err = writable(); err != nil {
+			return nil, err
+		}
 	}
-	FSMutex.Unlock()
-	return &res, nil
+	// files opened for writing (torrent clients open what they seed so) are
+	// only staged when written to, staging needs the whole content, unless
+	// it is truncated
+	if rw && req.Flags & fuse.OpenTruncate != 0 {
+		d, err = getDirty(f.Id, true)
+		if err != nil {
+			log.Print(err)
+			return nil, fuse.EIO
+		}
+	} else {
+		d = openDirty(f.Id)
+	}
+	if d != nil {
+		return &FuseFileHandle{Cur: NullId, Id: f.Id, Dirty: d, Writable: rw}, nil
+	}
+	preFetch(f.Id)
+	h := newFileHandle(f.Id)
+	h.Writable = rw
+	return h, nil
 }
 
 func (f *FuseFileHandle) Read(ctx context.Context, req *fuse.ReadRequest, resp *fuse.ReadResponse) error {
 	var l, r uint64
 	l = uint64(req.Offset)
 	r = l + uint64(req.Size)
-	resp.Data = f.readBytes(l, r)
+	var buf []byte
+	d, err := f.staged(false)
+	if d != nil {
+		buf, err = d.readAt(l, r)
+	} else {
+		buf, err = f.readBytes(l, r)
+	}
+	if err != nil {
+		log.Print(err)
+		return fuse.EIO
+	}
+	resp.Data = buf
 	return nil
 }
 
 func (f *FuseFileHandle) Release(ctx context.Context, req *fuse.ReleaseRequest) error {
-	if f.Cur != NullId {
-		closeNodeFile(f.Cur, f.File)
-		f.Cur = NullId
-	}
+	f.close()
 	return nil
 }
 
@@ -1014,7 +1166,6 @@ func mountMain() {
 		fuse.LocalVolume(),
 		fuse.VolumeName("seed"),
 		fuse.MaxReadahead(2097152),
-		fuse.ReadOnly(),
 		fuse.AllowOther(),
 	)
 	if err != nil {
@@ -1022,6 +1173,13 @@ func mountMain() {
 	}
 	defer c.Close()
 
+	cleanStaged()
+	loadCacheIndex()
+	go saveCacheIndexLoop()
+	go commitLoop()
+	go saveLoop()
+	go backupLoop()
+
 	go func() {
 		<-sigs
 		fuse.Unmount(MOUNT_POINT)
@@ -1032,6 +1190,12 @@ func mountMain() {
 	if err != nil {
 		log.Fatal(err)
 	}
+	if Writer {
+		log.Print("committing writes")
+		commitAll()
+		autoBackup()
+	}
+	saveCacheIndex()
 
 	// check if the mount process has an error to report
 	<-c.Ready
@@ -1042,23 +1206,45 @@ func mountMain() {
 
 func main() {
 	fmt.Sprintf("just to ban the warning")
-	load()
-	log.Print("load ok")
-
+	backendName := flag.String("backend", BACKEND, "storage backend (drive, local, s3, webdav), or several separated by commas")
+	flag.IntVar(&Replicas, "replicas", REPLICAS, "copies of each block to upload")
+	ec := flag.String("ec", EC, "erasure code blocks in K+M shards instead")
+	flag.IntVar(&backend.Slots, "slots", backend.SLOTS, "uploads, and other transfers, at once per account")
 	flag.Parse()
+	if backend.Slots < 1 {
+		log.Fatal("-slots should be at least 1")
+	}
+	// restore is also for when fs_data can't be loaded
+	if flag.Arg(0) != "restore" {
+		load()
+		log.Print("load ok")
+	}
+
+	Remote = backend.New(*backendName)
+	parseEC(*ec)
+	os.MkdirAll(TMP_PATH, 0755)
+	os.MkdirAll(WRITE_PATH, 0755)
+	os.MkdirAll(CACHE_PATH, 0755)
 
 	if flag.Arg(0) == "mount" {
-		backend.Load()
+		lockFS(false)
+		Remote.Load()
+		checkEC()
 		mountMain()
 		return
 	}
 	if flag.Arg(0) == "copy" {
-		backend.Load()
+		lockFS(false)
+		Remote.Load()
+		checkEC()
+		mustLockWriter()
 		src := flag.Arg(1)
 		dst := flag.Arg(2)
 		copyPath(src, dst)
+		waitUploads()
 		save()
-		backend.Save()
+		autoBackup()
+		Remote.Save()
 		os.Stat(MOUNT_POINT + "/__refresh__")
 		return
 	}
@@ -1067,18 +1253,110 @@ func main() {
 		return
 	}
 	if flag.Arg(0) == "fix" {
-		backend.Load()
+		lockFS(false)
+		Remote.Load()
+		checkEC()
+		mustLockWriter()
 		src := flag.Arg(1)
 		dst := flag.Arg(2)
 		checkPath(src, dst)
+		waitUploads()
 		save()
-		backend.Save()
+		autoBackup()
+		Remote.Save()
 		os.Stat(MOUNT_POINT + "/__refresh__")
 		return
 	}
+	if flag.Arg(0) == "repack" {
+		lockFS(false)
+		Remote.Load()
+		checkEC()
+		percent := REPACK_LIVE_PERCENT
+		if flag.Arg(1) != "" {
+			t, err := strconv.ParseUint(flag.Arg(1), 10, 64)
+			if err != nil {
+				log.Fatal(err)
+			}
+			percent = t
+		}
+		mustLockWriter()
+		repackMain(percent)
+		waitUploads()
+		save()
+		autoBackup()
+		Remote.Save()
+		os.Stat(MOUNT_POINT + "/__refresh__")
+		return
+	}
+	if flag.Arg(0) == "gc" {
+		Remote.Load()
+		ok := gcMain()
+		autoBackup()
+		Remote.Save()
+		if !ok {
+			os.Exit(1)
+		}
+		return
+	}
+	if flag.Arg(0) == "scan" {
+		lockFS(false)
+		Remote.Load()
+		checkEC()
+		// before the interrupted uploads are resumed, so that the finished
+		// ones are found
+		if !takeWriter(false) {
+			log.Fatal("fs_data is being changed by another process (", WRITER_LOCK_FILE, ")")
+		}
+		scanMain()
+		save()
+		resumeUploads()
+		waitUploads()
+		save()
+		autoBackup()
+		Remote.Save()
+		os.Stat(MOUNT_POINT + "/__refresh__")
+		return
+	}
+	if flag.Arg(0) == "repair" {
+		lockFS(false)
+		Remote.Load()
+		mustLockWriter()
+		repairMain()
+		save()
+		autoBackup()
+		Remote.Save()
+		os.Stat(MOUNT_POINT + "/__refresh__")
+		return
+	}
+	if flag.Arg(0) == "backup" {
+		// so that gc doesn't renumber the nodes under it
+		lockFS(false)
+		Remote.Load()
+		backupMain(flag.Arg(1) == "list")
+		Remote.Save()
+		return
+	}
+	if flag.Arg(0) == "restore" {
+		Remote.Load()
+		restoreMain(flag.Arg(1))
+		Remote.Save()
+		return
+	}
+	if flag.Arg(0) == "accounts" {
+		Remote.Load()
+		a, ok := Remote.(backend.Accounts)
+		if !ok {
+			log.Fatal("the backend has no accounts")
+		}
+		for _, s := range a.AccountStatus() {
+			fmt.Println(s)
+		}
+		return
+	}
 	if flag.Arg(0) == "drive" && flag.Arg(1) == "addtoken" {
-		backend.Load()
-		backend.AddToken()
+		d := &backend.Drive{}
+		d.Load()
+		d.AddToken()
 		return
 	}
 	//backend.Load()
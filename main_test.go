@@ -0,0 +1,258 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"./backend"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+)
+
+// testFS moves the test to a new dir holding an empty fs on backends (as
+// given to -backend), and makes it the writer of the journal. The returned
+// func puts everything back.
+func testFS(t *testing.T, backends string) func() {
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	dir, err := ioutil.TempDir("", "seeefs")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = os.Chdir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(CACHE_PATH, 0755)
+	os.MkdirAll(TMP_PATH, 0755)
+	Remote = backend.New(backends)
+	Remote.Load()
+	cryptLoaded = false
+	CryptSalt = [16]byte{}
+	CachedNodes = nil
+	CacheTotalSize = 0
+	clear()
+	mustLockWriter()
+	return func() {
+		waitFill()
+		crashWriter()
+		cryptLoaded = false
+		Replicas = 0
+		ECData, ECParity = 0, 0
+		os.Chdir(wd)
+		os.RemoveAll(dir)
+	}
+}
+
+// crashWriter closes the journal and gives up the writer lock without
+// saving, as a crash would.
+func crashWriter() {
+	JournalMutex.Lock()
+	if JournalFile != nil {
+		JournalFile.Close()
+	}
+	JournalFile = nil
+	JournalMutex.Unlock()
+	Writer = false
+	if writerLock != nil {
+		writerLock.Close()
+		writerLock = nil
+	}
+}
+
+// reload forgets the fs and loads it again from fs_data and the journal, as
+// after a crash.
+func reload() {
+	waitFill()
+	crashWriter()
+	clear()
+	CachedNodes = nil
+	CacheTotalSize = 0
+	load()
+}
+
+// emptyCache drops every block from the cache, so that they are downloaded
+// again.
+func emptyCache() {
+	waitFill()
+	CacheListMutex.Lock()
+	for i := range NodesChunks {
+		dropCache(uint64(i))
+		NodesCacheSize[i] = 0
+	}
+	CacheTotalSize = 0
+	CacheListMutex.Unlock()
+}
+
+// waitFill waits for the blocks being cached in the background.
+func waitFill() {
+	for true {
+		CacheListMutex.Lock()
+		busy := false
+		for _, f := range NodesFilling {
+			busy = busy || f
+		}
+		CacheListMutex.Unlock()
+		if !busy {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// writeTree creates the files of tree, by path, below dir.
+func writeTree(t *testing.T, dir string, tree map[string][]byte) {
+	for p, data := range tree {
+		p = filepath.Join(dir, p)
+		os.MkdirAll(filepath.Dir(p), 0755)
+		err := ioutil.WriteFile(p, data, 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+// fileId returns the id of file path of the fs, NullId if there is none.
+func fileId(path string) uint64 {
+	i := strings.LastIndex(path, "/")
+	var d uint64 = 0
+	if i > 0 {
+		var e int
+		d, e = getPath(path[:i])
+		if e != 0 {
+			return NullId
+		}
+	}
+	return getChildFile(d, path[i + 1:])
+}
+
+// readFile reads file path of the fs whole, and waits for the blocks it
+// started to cache, which a load would pull from under them.
+func readFile(t *testing.T, path string) []byte {
+	id := fileId(path)
+	if id == NullId {
+		t.Fatal("no file", path)
+	}
+	h := newFileHandle(id)
+	defer waitFill()
+	defer h.close()
+	res, err := h.readBytes(0, h.Size)
+	if err != nil {
+		t.Fatal(path, err)
+	}
+	return res
+}
+
+// lookup walks path from the root of the mount.
+func lookup(t *testing.T, path string) fusefs.Node {
+	node, err := FuseFS{}.Root()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range strings.Split(path, "/") {
+		if name == "" {
+			continue
+		}
+		d, ok := node.(FuseDir)
+		if !ok {
+			t.Fatal(path, "goes through a file")
+		}
+		node, err = d.Lookup(nil, name)
+		if err != nil {
+			t.Fatal(path, err)
+		}
+	}
+	return node
+}
+
+// readMount reads file f of the mount whole, as the kernel would.
+func readMount(t *testing.T, f FuseFile) []byte {
+	var attr fuse.Attr
+	f.Attr(nil, &attr)
+	h, err := f.Open(nil, &fuse.OpenRequest{Flags: fuse.OpenReadOnly}, &fuse.OpenResponse{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	fh := h.(*FuseFileHandle)
+	defer waitFill()
+	defer fh.Release(nil, &fuse.ReleaseRequest{})
+	res := make([]byte, 0, attr.Size)
+	for uint64(len(res)) < attr.Size {
+		resp := &fuse.ReadResponse{}
+		err = fh.Read(nil, &fuse.ReadRequest{Offset: int64(len(res)), Size: 131072}, resp)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(resp.Data) == 0 {
+			t.Fatal("short read")
+		}
+		res = append(res, resp.Data...)
+	}
+	return res
+}
+
+// A tree copied to the local backend reads back the same through the mount,
+// once loaded again with nothing cached.
+func TestCopyRead(t *testing.T) {
+	defer testFS(t, "local")()
+	big := make([]byte, 3 * 1048576 + 12345)
+	rand.Read(big)
+	writeTree(t, "src", map[string][]byte{
+		"a.txt": []byte("hello"),
+		"empty": []byte{},
+		"same.txt": []byte("hello"),
+		"sub/b.bin": big,
+		"sub/deeper/c": []byte(strings.Repeat("seeefs ", 10000)),
+		"sub/deeper/d": big[:1000],
+	})
+	os.Symlink("a.txt", "src/link")
+	copyPath("src", "/dst")
+	waitUploads()
+	save()
+	reload()
+	emptyCache()
+	n := 0
+	err := filepath.Walk("src", func(p string, fi os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		node := lookup(t, "/dst" + strings.TrimPrefix(p, "src"))
+		n++
+		switch {
+		case fi.IsDir():
+			d, ok := node.(FuseDir)
+			if !ok {
+				t.Fatal(p, "is not a dir")
+			}
+			ents, _ := d.ReadDirAll(nil)
+			names, _ := ioutil.ReadDir(p)
+			if len(ents) != len(names) {
+				t.Fatal(p, ents)
+			}
+		case fi.Mode() & os.ModeSymlink != 0:
+			target, err := node.(FuseFile).Readlink(nil, &fuse.ReadlinkRequest{})
+			want, _ := os.Readlink(p)
+			if err != nil || target != want {
+				t.Fatal(p, target, err)
+			}
+		default:
+			want, _ := ioutil.ReadFile(p)
+			if !bytes.Equal(readMount(t, node.(FuseFile)), want) {
+				t.Fatal(p, "differs")
+			}
+		}
+		return nil
+	})
+	if err != nil || n != 10 {
+		t.Fatal(n, err)
+	}
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"crypto/sha512"
+	"log"
+	"os"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// file type bits of st_mode
+const (
+	S_IFMT uint32 = 0170000
+	S_IFDIR uint32 = 0040000
+	S_IFREG uint32 = 0100000
+	S_IFLNK uint32 = 0120000
+)
+
+// modeBits turns the permissions of m into st_mode bits.
+func modeBits(m os.FileMode) uint32 {
+	res := uint32(m.Perm())
+	if m & os.ModeSetuid != 0 {
+		res |= 04000
+	}
+	if m & os.ModeSetgid != 0 {
+		res |= 02000
+	}
+	if m & os.ModeSticky != 0 {
+		res |= 01000
+	}
+	return res
+}
+
+func fileMode(m uint32) os.FileMode {
+	res := os.FileMode(m & 0777)
+	if m & 04000 != 0 {
+		res |= os.ModeSetuid
+	}
+	if m & 02000 != 0 {
+		res |= os.ModeSetgid
+	}
+	if m & 01000 != 0 {
+		res |= os.ModeSticky
+	}
+	return res
+}
+
+func modeMeta(fi os.FileInfo) Meta {
+	typ := S_IFREG
+	if fi.IsDir() {
+		typ = S_IFDIR
+	} else if fi.Mode() & os.ModeSymlink != 0 {
+		typ = S_IFLNK
+	}
+	t := fi.ModTime().UnixNano()
+	return Meta{Mode: typ | modeBits(fi.Mode()), Mtime: t, Ctime: t}
+}
+
+// newMeta is the metadata of something of type typ made on the mount.
+func newMeta(typ uint32, mode os.FileMode, h fuse.Header) Meta {
+	t := time.Now().UnixNano()
+	return Meta{Mode: typ | modeBits(mode), Uid: h.Uid, Gid: h.Gid, Mtime: t, Ctime: t}
+}
+
+// attr fills a from m, with the permissions def if they aren't known.
+func (m Meta) attr(a *fuse.Attr, typ, def os.FileMode) {
+	a.Mode = typ | def
+	if m.Mode != 0 {
+		a.Mode = typ | fileMode(m.Mode)
+	}
+	a.Uid = m.Uid
+	a.Gid = m.Gid
+	if m.Mtime != 0 {
+		a.Mtime = time.Unix(0, m.Mtime)
+		a.Atime = a.Mtime
+	}
+	if m.Ctime != 0 {
+		a.Ctime = time.Unix(0, m.Ctime)
+	}
+}
+
+// metaValid tells if v changes anything kept in Meta.
+func metaValid(v fuse.SetattrValid) bool {
+	return v.Mode() || v.Uid() || v.Gid() || v.Mtime() || v.MtimeNow()
+}
+
+// setattr applies the changes of req to m, of type typ.
+func (m *Meta) setattr(req *fuse.SetattrRequest, typ uint32) {
+	v := req.Valid
+	if v.Mode() {
+		m.Mode = typ | modeBits(req.Mode)
+	}
+	if v.Uid() {
+		m.Uid = req.Uid
+	}
+	if v.Gid() {
+		m.Gid = req.Gid
+	}
+	now := time.Now().UnixNano()
+	if v.MtimeNow() {
+		m.Mtime = now
+	} else if v.Mtime() {
+		m.Mtime = req.Mtime.UnixNano()
+	}
+	m.Ctime = now
+}
+
+// setDirMeta is like addChild, FSMutex must be held if others may look.
+func setDirMeta(n uint64, m Meta) {
+	Dirs[n].Meta = m
+	journalAttr(n, true)
+}
+
+// makeLink makes file t the symlink at path, which fi describes.
+func makeLink(t uint64, path string, fi os.FileInfo) {
+	target, err := os.Readlink(path)
+	if err != nil {
+		log.Fatal(err)
+	}
+	FSMutex.Lock()
+	dropLookup(t)
+	Files[t].Link = target
+	Files[t].Size = uint64(len(target))
+	Files[t].SHA512 = [sha512.Size]byte{}
+	Files[t].Storage = noStorage()
+	Files[t].Meta = statMeta(fi)
+	journalFile(t)
+	FSMutex.Unlock()
+}
+
+func (f FuseFile) Readlink(ctx context.Context, req *fuse.ReadlinkRequest) (string, error) {
+	FSMutex.Lock()
+	defer FSMutex.Unlock()
+	if Files[f.Id].Link == "" {
+		return "", fuse.Errno(syscall.EINVAL)
+	}
+	return Files[f.Id].Link, nil
+}
+
+func (f FuseDir) Symlink(ctx context.Context, req *fuse.SymlinkRequest) (fusefs.Node, error) {
+	if err := writable(); err != nil {
+		return nil, err
+	}
+	FSMutex.Lock()
+	_, ok1 := Dirs[f.Id].ChildMap[req.NewName]
+	_, ok2 := Dirs[f.Id].FilesMap[req.NewName]
+	if ok1 || ok2 {
+		FSMutex.Unlock()
+		return nil, fuse.EEXIST
+	}
+	n := addChildFile(f.Id, req.NewName)
+	Files[n].Link = req.Target
+	Files[n].Size = uint64(len(req.Target))
+	Files[n].Meta = newMeta(S_IFLNK, 0777, req.Header)
+	journalFile(n)
+	FSMutex.Unlock()
+	return FuseFile{n}, nil
+}
+
+func (f FuseDir) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if !metaValid(req.Valid) {
+		return nil
+	}
+	if err := writable(); err != nil {
+		return err
+	}
+	FSMutex.Lock()
+	Dirs[f.Id].Meta.setattr(req, S_IFDIR)
+	journalAttr(f.Id, true)
+	FSMutex.Unlock()
+	return nil
+}
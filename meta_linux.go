@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"os"
+	"syscall"
+)
+
+// statMeta returns the metadata of fi, as given by os.Lstat or os.Stat.
+func statMeta(fi os.FileInfo) Meta {
+	st, ok := fi.Sys().(*syscall.Stat_t)
+	if !ok {
+		return modeMeta(fi)
+	}
+	return Meta{Mode: st.Mode, Uid: st.Uid, Gid: st.Gid, Mtime: st.Mtim.Nano(), Ctime: st.Ctim.Nano()}
+}
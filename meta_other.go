@@ -0,0 +1,14 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import (
+	"os"
+)
+
+// statMeta only knows the mode and mtime of fi here, the ctime is taken to
+// be the mtime.
+func statMeta(fi os.FileInfo) Meta {
+	return modeMeta(fi)
+}
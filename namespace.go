@@ -0,0 +1,134 @@
+package main
+
+import (
+	"syscall"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// isAncestor tells if dir a is dir b or one of its ancestors.
+func isAncestor(a, b uint64) bool {
+	if a == b {
+		return true
+	}
+	for _, c := range Dirs[a].Child {
+		if isAncestor(c, b) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f FuseDir) Mkdir(ctx context.Context, req *fuse.MkdirRequest) (fusefs.Node, error) {
+	if err := writable(); err != nil {
+		return nil, err
+	}
+	FSMutex.Lock()
+	_, ok1 := Dirs[f.Id].ChildMap[req.Name]
+	_, ok2 := Dirs[f.Id].FilesMap[req.Name]
+	if ok1 || ok2 {
+		FSMutex.Unlock()
+		return nil, fuse.EEXIST
+	}
+	n := addChild(f.Id, req.Name)
+	setDirMeta(n, newMeta(S_IFDIR, req.Mode &^ req.Umask, req.Header))
+	FSMutex.Unlock()
+	return FuseDir{n}, nil
+}
+
+func (f FuseDir) Remove(ctx context.Context, req *fuse.RemoveRequest) error {
+	if err := writable(); err != nil {
+		return err
+	}
+	FSMutex.Lock()
+	if req.Dir {
+		n, ok := Dirs[f.Id].ChildMap[req.Name]
+		if !ok {
+			_, ok = Dirs[f.Id].FilesMap[req.Name]
+			FSMutex.Unlock()
+			if ok {
+				return fuse.Errno(syscall.ENOTDIR)
+			}
+			return fuse.ENOENT
+		}
+		if len(Dirs[n].Child) > 0 || len(Dirs[n].Files) > 0 {
+			FSMutex.Unlock()
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+		removeDir(f.Id, n)
+		journalRemove(f.Id, n, true)
+	} else {
+		n, ok := Dirs[f.Id].FilesMap[req.Name]
+		if !ok {
+			_, ok = Dirs[f.Id].ChildMap[req.Name]
+			FSMutex.Unlock()
+			if ok {
+				return fuse.Errno(syscall.EISDIR)
+			}
+			return fuse.ENOENT
+		}
+		removeFile(f.Id, n)
+		journalRemove(f.Id, n, false)
+	}
+	FSMutex.Unlock()
+	return nil
+}
+
+func (f FuseDir) Rename(ctx context.Context, req *fuse.RenameRequest, newDir fusefs.Node) error {
+	t, ok := newDir.(FuseDir)
+	if !ok {
+		return fuse.EIO
+	}
+	if err := writable(); err != nil {
+		return err
+	}
+	FSMutex.Lock()
+	err := rename(f.Id, req.OldName, t.Id, req.NewName)
+	if err == nil {
+		journalRename(f.Id, req.OldName, t.Id, req.NewName)
+	}
+	FSMutex.Unlock()
+	return err
+}
+
+// rename moves x/a to y/b, replacing what y/b was if possible. FSMutex must
+// be held.
+func rename(x uint64, a string, y uint64, b string) error {
+	if x == y && a == b {
+		return nil
+	}
+	td, isDir := Dirs[y].ChildMap[b]
+	tf, isFile := Dirs[y].FilesMap[b]
+	if n, ok := Dirs[x].FilesMap[a]; ok {
+		if isDir {
+			return fuse.Errno(syscall.EISDIR)
+		}
+		if isFile {
+			removeFile(y, tf)
+		}
+		unlinkChildFile(x, n)
+		linkChildFile(y, n, b)
+		return nil
+	}
+	n, ok := Dirs[x].ChildMap[a]
+	if !ok {
+		return fuse.ENOENT
+	}
+	if isFile {
+		return fuse.Errno(syscall.ENOTDIR)
+	}
+	if isAncestor(n, y) {
+		return fuse.Errno(syscall.EINVAL)
+	}
+	if isDir {
+		if len(Dirs[td].Child) > 0 || len(Dirs[td].Files) > 0 {
+			return fuse.Errno(syscall.ENOTEMPTY)
+		}
+		removeDir(y, td)
+	}
+	unlinkChild(x, n)
+	linkChild(y, n, b)
+	return nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"time"
+)
+
+// where repack puts the files it takes out of their blocks
+const REPACK_PATH = TMP_PATH + "repack/"
+
+type extent struct {
+	Node, Pos uint64
+}
+
+// repackMain copies the live files of packed blocks which are less than
+// percent% live into new blocks. The old blocks are left to gc.
+func repackMain(percent uint64) {
+	os.MkdirAll(REPACK_PATH, 0755)
+	old_node := len(Nodes)
+	live := make([]uint64, len(Nodes))
+	groups := make(map[extent][]uint64)
+	order := make([]extent, 0)
+	for _, i := range liveFiles(0) {
+		if len(Files[i].Storage.Nodes) > 0 || Files[i].Link != "" || Files[i].Storage.NodeId == NullId {
+			continue
+		}
+		// files linked by hash share their extent, it is moved once
+		e := extent{Files[i].Storage.NodeId, Files[i].Storage.NodePos}
+		if _, ok := groups[e]; !ok {
+			live[e.Node] += Files[i].Size
+			order = append(order, e)
+		}
+		groups[e] = append(groups[e], i)
+	}
+	s := make([]NewFile, 0)
+	nodes := make(map[uint64]bool)
+	for _, e := range order {
+		size := Nodes[e.Node].Size
+		if live[e.Node] * 100 >= size * percent {
+			continue
+		}
+		nodes[e.Node] = true
+		id := groups[e][0]
+		h := newFileHandle(id)
+		buf, err := h.readBytes(0, h.Size)
+		h.close()
+		if err != nil {
+			log.Fatal(err)
+		}
+		path := REPACK_PATH + strconv.FormatUint(id, 10)
+		err = ioutil.WriteFile(path, buf, 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+		s = append(s, NewFile{id, h.Size, path})
+	}
+	var freed uint64 = 0
+	for n, _ := range nodes {
+		freed += Nodes[n].Size - live[n]
+	}
+	fmt.Println("repack:", len(nodes), "blocks,", len(s), "files,", freed, "dead bytes")
+	if len(s) == 0 {
+		return
+	}
+	makeFiles(s, true, true)
+	FSMutex.Lock()
+	for _, e := range order {
+		if !nodes[e.Node] {
+			continue
+		}
+		g := groups[e]
+		for j := 1; j < len(g); j++ {
+			Files[g[j]].Storage = Files[g[0]].Storage
+			journalFile(g[j])
+		}
+	}
+	FSMutex.Unlock()
+	for true {
+		if checkUploaded(old_node, false) { break }
+		time.Sleep(2 * time.Second)
+	}
+	for _, t := range s {
+		os.Remove(t.Path)
+	}
+	fmt.Println("repack ok, run gc to delete the old blocks")
+}
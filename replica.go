@@ -0,0 +1,113 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"./backend"
+)
+
+// A copy of a block which failed to download (account suspended or over
+// quota, object gone...) is tried after the others for SOURCE_RETRY.
+const SOURCE_RETRY = 10 * time.Minute
+
+var sourceFailures = make(map[string]time.Time)
+var sourceMutex sync.Mutex
+
+// sourceBad tells if src failed lately.
+func sourceBad(src string) bool {
+	sourceMutex.Lock()
+	defer sourceMutex.Unlock()
+	t, ok := sourceFailures[src]
+	if ok && time.Since(t) >= SOURCE_RETRY {
+		delete(sourceFailures, src)
+		return false
+	}
+	return ok
+}
+
+// sourceOrder returns srcs, the ones which failed lately last.
+func sourceOrder(srcs []string) []string {
+	res := make([]string, 0, len(srcs))
+	late := make([]string, 0)
+	for _, src := range srcs {
+		if sourceBad(src) {
+			late = append(late, src)
+		} else {
+			res = append(res, src)
+		}
+	}
+	return append(res, late...)
+}
+
+func sourceFailed(src string, err error) {
+	log.Print("download from ", src, " failed: ", err)
+	sourceMutex.Lock()
+	sourceFailures[src] = time.Now()
+	sourceMutex.Unlock()
+}
+
+// readSource downloads n bytes at off of the stored block from the first of
+// its copies that works.
+func readSource(node Node, off, n uint64, prio int) ([]byte, error) {
+	var err error
+	for _, src := range sourceOrder(node.Sources) {
+		var res []byte
+		res, err = backend.ReadRange(Remote, src, off, n, prio)
+		if err == nil {
+			return res, nil
+		}
+		sourceFailed(src, err)
+	}
+	return nil, err
+}
+
+// uploaded tells if node is on the remote, as copies or as shards.
+func uploaded(node Node) bool {
+	return len(node.Sources) > 0 || len(node.Shards) > 0
+}
+
+// readRemote downloads n bytes at off of the stored block.
+func readRemote(node Node, off, n uint64, prio int) ([]byte, error) {
+	if len(node.Shards) > 0 {
+		return readShards(node, off, n, prio)
+	}
+	return readSource(node, off, n, prio)
+}
+
+// mainSource is the first copy of node, "" if it isn't uploaded.
+func mainSource(node Node) string {
+	if len(node.Sources) == 0 {
+		return ""
+	}
+	return node.Sources[0]
+}
+
+// replicaSources are the copies of node after the first one.
+func replicaSources(node Node) []string {
+	if len(node.Sources) <= 1 {
+		return nil
+	}
+	return node.Sources[1:]
+}
+
+// sourcesString lists the copies of node, or its shards after "rsK+M:".
+func sourcesString(node Node) string {
+	if len(node.Shards) > 0 {
+		t := make([]string, len(node.Shards))
+		for i, src := range node.Shards {
+			t[i] = src
+			if src == "" {
+				t[i] = "-"
+			}
+		}
+		return fmt.Sprintf("rs%d+%d:", node.DataShards, uint64(len(node.Shards)) - node.DataShards) + strings.Join(t, ",")
+	}
+	if len(node.Sources) == 0 {
+		return "-"
+	}
+	return strings.Join(node.Sources, ",")
+}
@@ -0,0 +1,283 @@
+package main
+
+import (
+	"bufio"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"strconv"
+	"strings"
+
+	"./backend"
+)
+
+// remoteSize is the size of node as uploaded.
+func remoteSize(node Node) uint64 {
+	if node.Flags & NODE_ENCRYPTED != 0 {
+		return cryptStoredSize(storedSize(node))
+	}
+	return storedSize(node)
+}
+
+// objectNode is the node an object was uploaded for, from its name "fo_id",
+// or "fo_id.j.k.m" for shard j of k + m, shard being then j, k and m.
+func objectNode(o backend.Object) (uint64, []uint64, bool) {
+	pos := strings.Index(o.Name, "_")
+	if pos == -1 {
+		return 0, nil, false
+	}
+	t := strings.Split(o.Name[pos + 1:], ".")
+	if len(t) != 1 && len(t) != 4 {
+		return 0, nil, false
+	}
+	res := make([]uint64, len(t))
+	for i := range t {
+		var err error
+		res[i], err = strconv.ParseUint(t[i], 10, 64)
+		if err != nil {
+			return 0, nil, false
+		}
+	}
+	return res[0], res[1:], true
+}
+
+// SCAN_READ_SIZE is how much of a block is downloaded at once to check it.
+const SCAN_READ_SIZE = 4 << 20
+
+// remoteReader reads the stored form of node from the remote.
+type remoteReader struct {
+	node Node
+	off uint64
+}
+
+func (r *remoteReader) Read(p []byte) (int, error) {
+	size := remoteSize(r.node)
+	if r.off >= size {
+		return 0, io.EOF
+	}
+	n := uint64(len(p))
+	if n > size - r.off {
+		n = size - r.off
+	}
+	buf, err := readRemote(r.node, r.off, n, backend.PRIO_PREFETCH)
+	if err != nil {
+		return 0, err
+	}
+	r.off += n
+	return copy(p, buf), nil
+}
+
+// checkRemote tells if node, with what was found on the remote for node i,
+// is the block of its hash.
+func checkRemote(i uint64, node Node) bool {
+	if node.Hash == [sha256.Size]byte{} {
+		fmt.Println("node", i, "has no hash to check", sourcesString(node), "against")
+		return false
+	}
+	hash, err := blockHash(node, bufio.NewReaderSize(&remoteReader{node: node}, SCAN_READ_SIZE))
+	if err == nil && hash != node.Hash {
+		err = errors.New("content doesn't match")
+	}
+	if err != nil {
+		fmt.Println("node", i, sourcesString(node), ":", err)
+		return false
+	}
+	return true
+}
+
+// shardSet gathers the shards found for a node.
+type shardSet struct {
+	k uint64
+	objs []backend.Object
+}
+
+// scanMain lists the blocks on the remote, rebuilding the folder ids the
+// backend keeps. Nodes without a source, whose upload finished but wasn't
+// saved, get the objects (or shards) of their id and size back, once their
+// content is checked against the hash of the node. Objects no
+// node uses and used nodes found nowhere are reported.
+func scanMain() {
+	if dc, ok := Remote.(backend.DirCache); ok {
+		err := dc.RebuildDirs()
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	objs, err := Remote.List()
+	if err != nil {
+		log.Fatal(err)
+	}
+	fmt.Println("scan:", len(objs), "objects on the remote")
+	FSMutex.Lock()
+	used := nodeRefs()
+	known := make(map[string]bool)
+	// nodes whose upload may have finished unsaved, taking up to Replicas
+	// copies, or the shards of one erasure coding
+	empty := make(map[uint64]bool)
+	for i := 0; i < len(Nodes); i++ {
+		for _, src := range Nodes[i].Sources {
+			known[src] = true
+		}
+		for _, src := range Nodes[i].Shards {
+			known[src] = src != ""
+		}
+		if !uploaded(Nodes[i]) {
+			empty[uint64(i)] = true
+		}
+	}
+	want := Replicas
+	if want < 1 {
+		want = 1
+	}
+	orphans := make([]backend.Object, 0)
+	// copies, or shards, which may be those of a node, checked below
+	copies := make(map[uint64][]backend.Object)
+	sets := make(map[uint64]*shardSet)
+	for _, o := range objs {
+		if known[o.Source] {
+			continue
+		}
+		i, shard, ok := objectNode(o)
+		if !ok || !empty[i] {
+			orphans = append(orphans, o)
+			continue
+		}
+		if len(shard) == 0 {
+			if sets[i] == nil && o.Size == remoteSize(Nodes[i]) {
+				copies[i] = append(copies[i], o)
+				known[o.Source] = true
+				continue
+			}
+		} else {
+			j, k, m := shard[0], shard[1], shard[2]
+			ok = k > 0 && j < k + m && o.Size == (remoteSize(Nodes[i]) + k - 1) / k
+			if ok && sets[i] == nil && len(copies[i]) == 0 {
+				sets[i] = &shardSet{k, make([]backend.Object, k + m)}
+			}
+			if ok && sets[i] != nil && sets[i].k == k && uint64(len(sets[i].objs)) == k + m && sets[i].objs[j].Source == "" {
+				sets[i].objs[j] = o
+				known[o.Source] = true
+				continue
+			}
+		}
+		orphans = append(orphans, o)
+	}
+	nodes := make(map[uint64]Node)
+	for i := range empty {
+		nodes[i] = Nodes[i]
+	}
+	FSMutex.Unlock()
+	// the id and size of an object may be those of a node which gc renumbered
+	// since, the content tells
+	for i, found := range copies {
+		node := nodes[i]
+		for _, o := range found {
+			if len(node.Sources) >= want {
+				orphans = append(orphans, o)
+				continue
+			}
+			t := node
+			t.Sources = []string{o.Source}
+			if !checkRemote(i, t) {
+				orphans = append(orphans, o)
+				continue
+			}
+			node.Sources = append(node.Sources, o.Source)
+		}
+		nodes[i] = node
+	}
+	for i, set := range sets {
+		node := nodes[i]
+		t := make([]string, len(set.objs))
+		var c uint64 = 0
+		for j, o := range set.objs {
+			t[j] = o.Source
+			if o.Source != "" {
+				c++
+			}
+		}
+		node.DataShards = set.k
+		node.Shards = t
+		if c < set.k {
+			fmt.Println("node", i, "has", c, "shards of the", set.k, "needed")
+		}
+		if c < set.k || !checkRemote(i, node) {
+			for _, o := range set.objs {
+				if o.Source != "" {
+					orphans = append(orphans, o)
+				}
+			}
+			continue
+		}
+		nodes[i] = node
+	}
+	FSMutex.Lock()
+	attached := 0
+	for i := range empty {
+		if !uploaded(nodes[i]) {
+			continue
+		}
+		Nodes[i].Sources = nodes[i].Sources
+		Nodes[i].DataShards = nodes[i].DataShards
+		Nodes[i].Shards = nodes[i].Shards
+		fmt.Println("reattach node", i, sourcesString(Nodes[i]))
+		journalNode(i)
+		attached++
+		tmp := TMP_PATH + strconv.FormatUint(i, 10)
+		os.Remove(tmp)
+		os.Remove(tmp + ".enc")
+	}
+	present := make(map[string]bool)
+	for _, o := range objs {
+		present[o.Source] = true
+	}
+	missing := 0
+	for i := 0; i < len(Nodes); i++ {
+		if used[i] == 0 {
+			continue
+		}
+		if !uploaded(Nodes[i]) {
+			if _, err := os.Stat(TMP_PATH + strconv.FormatUint(uint64(i), 10)); err == nil {
+				continue
+			}
+			fmt.Println("node", i, "was never uploaded")
+			missing++
+			continue
+		}
+		if len(Nodes[i].Shards) > 0 {
+			var left uint64 = 0
+			for j, src := range Nodes[i].Shards {
+				if present[src] {
+					left++
+				} else {
+					fmt.Println("node", i, "has shard", j, "missing on the remote:", src)
+				}
+			}
+			if left < Nodes[i].DataShards {
+				missing++
+			}
+			continue
+		}
+		left := 0
+		for _, src := range Nodes[i].Sources {
+			if present[src] {
+				left++
+			} else {
+				fmt.Println("node", i, "has a copy missing on the remote:", src)
+			}
+		}
+		if left == 0 {
+			missing++
+		}
+	}
+	FSMutex.Unlock()
+	var sz uint64 = 0
+	for _, o := range orphans {
+		fmt.Println("orphan", o.Source, o.Name, o.Size)
+		sz += o.Size
+	}
+	fmt.Printf("scan: %d nodes reattached, %d orphan objects (%d bytes), %d used nodes lost\n", attached, len(orphans), sz, missing)
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"log"
+	"strconv"
+	"sync"
+	"time"
+
+	"./backend"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// Statfs reports the size of the files as used and the room left on the
+// backend, asked every QUOTA_INTERVAL, as free. Backends which can't tell,
+// or have no limit, show STATFS_UNLIMITED bytes free. What is written is
+// staged on the local disk, which the cache may still fill up to
+// CACHE_LIMIT, so the room left beside the cache bounds what is available.
+const STATFS_BLOCK_SIZE uint64 = 4096
+const STATFS_UNLIMITED uint64 = 1 << 50
+const QUOTA_INTERVAL = 5 * time.Minute
+
+var quotaTotal, quotaUsed uint64
+var quotaKnown, quotaAsking bool
+var quotaTime time.Time
+var quotaMutex sync.Mutex
+
+// getQuota returns the last quota of the backend, asking it again in the
+// background once it is too old. ok is false if it never told.
+func getQuota() (total, used uint64, ok bool) {
+	q, can := Remote.(backend.Quota)
+	if !can {
+		return 0, 0, false
+	}
+	quotaMutex.Lock()
+	defer quotaMutex.Unlock()
+	if !quotaAsking && time.Since(quotaTime) >= QUOTA_INTERVAL {
+		quotaAsking = true
+		go func() {
+			t, u, err := q.Quota()
+			if err != nil {
+				log.Print("quota: ", err)
+			}
+			quotaMutex.Lock()
+			if err == nil {
+				quotaTotal, quotaUsed, quotaKnown = t, u, true
+			}
+			quotaTime = time.Now()
+			quotaAsking = false
+			quotaMutex.Unlock()
+		}()
+	}
+	return quotaTotal, quotaUsed, quotaKnown
+}
+
+func (FuseFS) Statfs(ctx context.Context, req *fuse.StatfsRequest, resp *fuse.StatfsResponse) error {
+	FSMutex.Lock()
+	ids := liveFiles(0)
+	var used uint64 = 0
+	for _, i := range ids {
+		used += Files[i].Size
+	}
+	n := uint64(len(ids) + len(Dirs))
+	FSMutex.Unlock()
+	free := STATFS_UNLIMITED
+	if total, rused, ok := getQuota(); ok && total > 0 {
+		free = 0
+		if total > rused {
+			free = total - rused
+		}
+	}
+	resp.Bsize = uint32(STATFS_BLOCK_SIZE)
+	resp.Frsize = uint32(STATFS_BLOCK_SIZE)
+	resp.Blocks = (used + free) / STATFS_BLOCK_SIZE
+	resp.Bfree = free / STATFS_BLOCK_SIZE
+	if room := localRoom(); room < free {
+		free = room
+	}
+	resp.Bavail = free / STATFS_BLOCK_SIZE
+	// there is no limit on files, they aren't counted as free either
+	resp.Files = n
+	resp.Ffree = 0
+	resp.Namelen = 255
+	return nil
+}
+
+// localRoom returns the room left on the local disk once the cache has
+// grown to CACHE_LIMIT, STATFS_UNLIMITED if it can't tell.
+func localRoom() uint64 {
+	free, ok := diskFree(TMP_PATH)
+	if !ok {
+		return STATFS_UNLIMITED
+	}
+	CacheListMutex.Lock()
+	var grow uint64 = 0
+	if CacheTotalSize < CACHE_LIMIT {
+		grow = CACHE_LIMIT - CacheTotalSize
+	}
+	CacheListMutex.Unlock()
+	if free < grow {
+		return 0
+	}
+	return free - grow
+}
+
+// rootXattr gives the cache use and the backend quota on the root dir.
+func rootXattr(name string) (string, bool) {
+	switch name {
+	case "cache":
+		CacheListMutex.Lock()
+		defer CacheListMutex.Unlock()
+		return strconv.FormatUint(CacheTotalSize, 10) + "/" + strconv.FormatUint(CACHE_LIMIT, 10), true
+	case "quota":
+		total, used, ok := getQuota()
+		if !ok {
+			return "", false
+		}
+		return strconv.FormatUint(used, 10) + "/" + strconv.FormatUint(total, 10), true
+	}
+	return "", false
+}
@@ -0,0 +1,18 @@
+//go:build linux
+// +build linux
+
+package main
+
+import (
+	"syscall"
+)
+
+// diskFree returns the bytes free for users on the disk holding path, ok is
+// false if it can't tell.
+func diskFree(path string) (uint64, bool) {
+	var st syscall.Statfs_t
+	if syscall.Statfs(path, &st) != nil {
+		return 0, false
+	}
+	return st.Bavail * uint64(st.Bsize), true
+}
@@ -0,0 +1,9 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+// diskFree can't tell the room left on the disk here.
+func diskFree(path string) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"os"
+	"strconv"
+	"sync"
+	"syscall"
+	"time"
+
+	"bazil.org/fuse"
+	fusefs "bazil.org/fuse/fs"
+	"golang.org/x/net/context"
+)
+
+// A file opened for writing is staged whole in WRITE_PATH, named after its id
+// in Files, and reads of it are served from there. Once it has been left
+// alone for a while it is packed into blocks by makeFiles or makeBigFile like
+// copied files, and the blocks are uploaded.
+type dirtyFile struct {
+	Path string
+	File *os.File
+	// guarded by DirtyMutex
+	Size uint64
+	Open int
+	Gen, CommittedGen uint64
+	LastWrite time.Time
+	// mtime of the content, which is set on the file when committed
+	Mtime time.Time
+	// held while the staged file is written or committed
+	mutex sync.Mutex
+}
+
+var DirtyFiles = make(map[uint64]*dirtyFile)
+var DirtyMutex sync.Mutex
+var CommitMutex sync.Mutex
+
+// nodes being uploaded
+var Uploading int
+
+func stagePath(id uint64) string {
+	return WRITE_PATH + strconv.FormatUint(id, 10)
+}
+
+// openDirty returns the staged copy of file id, opened once more, or nil if
+// it has none.
+func openDirty(id uint64) *dirtyFile {
+	DirtyMutex.Lock()
+	defer DirtyMutex.Unlock()
+	d, ok := DirtyFiles[id]
+	if !ok {
+		return nil
+	}
+	d.Open++
+	return d
+}
+
+// getDirty is openDirty, but stages file id first if needed, with its
+// current content unless trunc is set.
+func getDirty(id uint64, trunc bool) (*dirtyFile, error) {
+	FSMutex.Lock()
+	mtime := time.Unix(0, Files[id].Mtime)
+	FSMutex.Unlock()
+	DirtyMutex.Lock()
+	d, ok := DirtyFiles[id]
+	if ok {
+		d.Open++
+		DirtyMutex.Unlock()
+		if trunc {
+			err := d.truncate(0)
+			if err != nil {
+				d.release()
+				return nil, err
+			}
+		}
+		return d, nil
+	}
+	d = &dirtyFile{Path: stagePath(id), Open: 1, LastWrite: time.Now(), Mtime: mtime}
+	d.mutex.Lock()
+	DirtyFiles[id] = d
+	DirtyMutex.Unlock()
+	FSMutex.Lock()
+	unshare(id)
+	FSMutex.Unlock()
+	size, err := d.stage(id, trunc)
+	DirtyMutex.Lock()
+	if err != nil {
+		delete(DirtyFiles, id)
+	}
+	d.Size = size
+	if trunc {
+		d.Gen++
+		d.Mtime = time.Now()
+	}
+	DirtyMutex.Unlock()
+	d.mutex.Unlock()
+	if err != nil {
+		if d.File != nil {
+			d.File.Close()
+		}
+		os.Remove(d.Path)
+		return nil, err
+	}
+	return d, nil
+}
+
+// unshare gives file id an inode of its own if linkExistsFile made it share
+// one with a file of the same content, which it is about to lose. FSMutex
+// must be held.
+func unshare(id uint64) {
+	// new files have no content to share
+	if Files[id].Storage.NodeId == NullId && len(Files[id].Storage.Nodes) == 0 {
+		return
+	}
+	for i := range Files {
+		if uint64(i) != id && Files[i].Inode == Files[id].Inode {
+			Inodes++
+			Files[id].Inode = Inodes
+			return
+		}
+	}
+}
+
+// cleanStaged removes what a mount which died left in WRITE_PATH, the writes
+// it didn't commit being lost as in a crash.
+func cleanStaged() {
+	files, err := ioutil.ReadDir(WRITE_PATH)
+	if err != nil {
+		log.Print(err)
+		return
+	}
+	for _, t := range files {
+		log.Print("dropping ", t.Name(), ", staged and never committed")
+		os.Remove(WRITE_PATH + t.Name())
+	}
+}
+
+// stage copies the committed content of file id to the staged file.
+func (d *dirtyFile) stage(id uint64, trunc bool) (uint64, error) {
+	var err error
+	d.File, err = os.OpenFile(d.Path, os.O_RDWR | os.O_CREATE | os.O_TRUNC, 0644)
+	if err != nil {
+		return 0, err
+	}
+	if trunc {
+		return 0, nil
+	}
+	h := newFileHandle(id)
+	defer h.close()
+	var l uint64
+	for l = 0; l < h.Size; l += MAX_BLOCK_SIZE {
+		buf, err := h.readBytes(l, l + MAX_BLOCK_SIZE)
+		if err != nil {
+			return 0, err
+		}
+		_, err = d.File.WriteAt(buf, int64(l))
+		if err != nil {
+			return 0, err
+		}
+	}
+	return h.Size, nil
+}
+
+func (d *dirtyFile) size() uint64 {
+	DirtyMutex.Lock()
+	defer DirtyMutex.Unlock()
+	return d.Size
+}
+
+func (d *dirtyFile) readAt(l, r uint64) ([]byte, error) {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	if size := d.size(); r > size {
+		r = size
+	}
+	if l >= r {
+		return make([]byte, 0), nil
+	}
+	buf := make([]byte, r - l)
+	_, err := d.File.ReadAt(buf, int64(l))
+	if err != nil {
+		return nil, err
+	}
+	return buf, nil
+}
+
+func (d *dirtyFile) writeAt(buf []byte, off uint64) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	_, err := d.File.WriteAt(buf, int64(off))
+	if err != nil {
+		return err
+	}
+	DirtyMutex.Lock()
+	if off + uint64(len(buf)) > d.Size {
+		d.Size = off + uint64(len(buf))
+	}
+	d.Gen++
+	d.LastWrite = time.Now()
+	d.Mtime = d.LastWrite
+	DirtyMutex.Unlock()
+	return nil
+}
+
+func (d *dirtyFile) truncate(size uint64) error {
+	d.mutex.Lock()
+	defer d.mutex.Unlock()
+	err := d.File.Truncate(int64(size))
+	if err != nil {
+		return err
+	}
+	DirtyMutex.Lock()
+	d.Size = size
+	d.Gen++
+	d.LastWrite = time.Now()
+	d.Mtime = d.LastWrite
+	DirtyMutex.Unlock()
+	return nil
+}
+
+func (d *dirtyFile) release() {
+	DirtyMutex.Lock()
+	d.Open--
+	d.LastWrite = time.Now()
+	DirtyMutex.Unlock()
+}
+
+// commitFiles packs the staged files ids into blocks and saves fs_data. Those
+// which are closed and weren't written meanwhile are unstaged.
+func commitFiles(ids []uint64) {
+	CommitMutex.Lock()
+	defer CommitMutex.Unlock()
+	ds := make([]*dirtyFile, 0)
+	dids := make([]uint64, 0)
+	gens := make([]uint64, 0)
+	small := make([]NewFile, 0)
+	changed := false
+	for _, id := range ids {
+		DirtyMutex.Lock()
+		d, ok := DirtyFiles[id]
+		DirtyMutex.Unlock()
+		if !ok {
+			continue
+		}
+		d.mutex.Lock()
+		DirtyMutex.Lock()
+		size := d.Size
+		mtime := d.Mtime
+		gen := d.Gen
+		clean := d.Gen == d.CommittedGen
+		DirtyMutex.Unlock()
+		FSMutex.Lock()
+		removed := Files[id].Name == ""
+		FSMutex.Unlock()
+		ds = append(ds, d)
+		dids = append(dids, id)
+		gens = append(gens, gen)
+		if clean || removed {
+			continue
+		}
+		log.Print("commit ", id, " ", size)
+		changed = true
+		// the old content may be linked to no more
+		FSMutex.Lock()
+		Files[id].Mtime = mtime.UnixNano()
+		Files[id].Ctime = time.Now().UnixNano()
+		dropLookup(id)
+		FSMutex.Unlock()
+		if size >= MIN_BLOCK_SIZE {
+			makeBigFile(id, size, d.Path, false)
+		} else {
+			small = append(small, NewFile{id, size, d.Path})
+		}
+	}
+	if len(small) > 0 {
+		makeFiles(small, true, false)
+	}
+	if changed {
+		save()
+	}
+	for i, d := range ds {
+		DirtyMutex.Lock()
+		d.CommittedGen = gens[i]
+		if d.Open == 0 && d.Gen == d.CommittedGen {
+			delete(DirtyFiles, dids[i])
+			d.File.Close()
+			os.Remove(d.Path)
+		}
+		DirtyMutex.Unlock()
+		d.mutex.Unlock()
+	}
+}
+
+// commitLoop commits staged files WRITE_DEBOUNCE after they were closed, or
+// WRITE_OPEN_DEBOUNCE after their last write if they are kept open.
+func commitLoop() {
+	for true {
+		time.Sleep(1 * time.Second)
+		ids := make([]uint64, 0)
+		DirtyMutex.Lock()
+		for id, d := range DirtyFiles {
+			wait := WRITE_DEBOUNCE
+			if d.Open > 0 {
+				wait = WRITE_OPEN_DEBOUNCE
+			}
+			if d.Gen == d.CommittedGen {
+				if d.Open == 0 {
+					ids = append(ids, id)
+				}
+			} else if time.Since(d.LastWrite) >= wait {
+				ids = append(ids, id)
+			}
+		}
+		DirtyMutex.Unlock()
+		if len(ids) > 0 {
+			commitFiles(ids)
+		}
+	}
+}
+
+// commitAll commits every staged file and waits for the uploads.
+func commitAll() {
+	ids := make([]uint64, 0)
+	DirtyMutex.Lock()
+	for id, _ := range DirtyFiles {
+		ids = append(ids, id)
+	}
+	DirtyMutex.Unlock()
+	commitFiles(ids)
+	waitUploads()
+	save()
+}
+
+func (f FuseDir) Create(ctx context.Context, req *fuse.CreateRequest, resp *fuse.CreateResponse) (fusefs.Node, fusefs.Handle, error) {
+	if err := writable(); err != nil {
+		return nil, nil, err
+	}
+	FSMutex.Lock()
+	if _, ok := Dirs[f.Id].ChildMap[req.Name]; ok {
+		FSMutex.Unlock()
+		return nil, nil, fuse.Errno(syscall.EISDIR)
+	}
+	id, ok := Dirs[f.Id].FilesMap[req.Name]
+	if ok && req.Flags & fuse.OpenExclusive != 0 {
+		FSMutex.Unlock()
+		return nil, nil, fuse.EEXIST
+	}
+	if !ok {
+		id = addChildFile(f.Id, req.Name)
+		Files[id].Meta = newMeta(S_IFREG, req.Mode &^ req.Umask, req.Header)
+	}
+	FSMutex.Unlock()
+	d, err := getDirty(id, true)
+	if err != nil {
+		log.Print(err)
+		return nil, nil, fuse.EIO
+	}
+	return FuseFile{id}, &FuseFileHandle{Cur: NullId, Id: id, Dirty: d}, nil
+}
+
+func (f FuseFile) Setattr(ctx context.Context, req *fuse.SetattrRequest, resp *fuse.SetattrResponse) error {
+	if !metaValid(req.Valid) && !req.Valid.Size() {
+		return nil
+	}
+	if err := writable(); err != nil {
+		return err
+	}
+	if metaValid(req.Valid) {
+		FSMutex.Lock()
+		typ := S_IFREG
+		if Files[f.Id].Link != "" {
+			typ = S_IFLNK
+		}
+		Files[f.Id].Meta.setattr(req, typ)
+		journalAttr(f.Id, false)
+		mtime := time.Unix(0, Files[f.Id].Mtime)
+		FSMutex.Unlock()
+		DirtyMutex.Lock()
+		if d, ok := DirtyFiles[f.Id]; ok && (req.Valid.Mtime() || req.Valid.MtimeNow()) {
+			d.Mtime = mtime
+		}
+		DirtyMutex.Unlock()
+	}
+	if !req.Valid.Size() {
+		return nil
+	}
+	d, err := getDirty(f.Id, req.Size == 0)
+	if err == nil {
+		if req.Size != 0 {
+			err = d.truncate(req.Size)
+		}
+		d.release()
+	}
+	if err != nil {
+		log.Print(err)
+		return fuse.EIO
+	}
+	return nil
+}
+
+func (f FuseFile) Fsync(ctx context.Context, req *fuse.FsyncRequest) error {
+	DirtyMutex.Lock()
+	_, ok := DirtyFiles[f.Id]
+	DirtyMutex.Unlock()
+	if ok {
+		commitFiles([]uint64{f.Id})
+	}
+	return nil
+}
+
+// staged returns the staged copy f reads from, nil if there is none. A handle
+// opened for writing takes the copy another one staged meanwhile, or stages
+// the file itself if stage is set.
+func (f *FuseFileHandle) staged(stage bool) (*dirtyFile, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if f.Dirty != nil || !f.Writable {
+		return f.Dirty, nil
+	}
+	if stage {
+		d, err := getDirty(f.Id, false)
+		if err != nil {
+			return nil, err
+		}
+		f.Dirty = d
+	} else {
+		f.Dirty = openDirty(f.Id)
+	}
+	return f.Dirty, nil
+}
+
+func (f *FuseFileHandle) Write(ctx context.Context, req *fuse.WriteRequest, resp *fuse.WriteResponse) error {
+	d, err := f.staged(true)
+	if err != nil {
+		log.Print(err)
+		return fuse.EIO
+	}
+	if d == nil {
+		return fuse.Errno(syscall.EBADF)
+	}
+	err = d.writeAt(req.Data, uint64(req.Offset))
+	if err != nil {
+		log.Print(err)
+		return fuse.EIO
+	}
+	resp.Size = len(req.Data)
+	return nil
+}
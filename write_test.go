@@ -0,0 +1,56 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// Writing one of two files copied with the same content leaves the other
+// one, and the inode they shared, alone.
+func TestWriteShared(t *testing.T) {
+	defer testFS(t, "local")()
+	os.MkdirAll(WRITE_PATH, 0755)
+	data := bytes.Repeat([]byte("seeefs "), 1000)
+	writeTree(t, "src", map[string][]byte{"a": data})
+	copyPath("src", "/dst")
+	copyPath("src", "/dst2")
+	waitUploads()
+	a, b := fileId("/dst/a"), fileId("/dst2/a")
+	if Files[a].Inode != Files[b].Inode {
+		t.Fatal("same content not linked")
+	}
+	d, err := getDirty(a, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	d.writeAt([]byte("S"), 0)
+	d.release()
+	if Files[a].Inode == Files[b].Inode {
+		t.Fatal("written file keeps the shared inode")
+	}
+	commitFiles([]uint64{a})
+	waitUploads()
+	emptyCache()
+	if !bytes.Equal(readFile(t, "/dst2/a"), data) {
+		t.Fatal("write went to the other file")
+	}
+	if !bytes.Equal(readFile(t, "/dst/a"), append([]byte("S"), data[1:]...)) {
+		t.Fatal("content")
+	}
+	if _, err := os.Stat(stagePath(a)); err == nil {
+		t.Fatal("closed file still staged")
+	}
+}
+
+// A mount drops what an earlier one staged and never committed.
+func TestCleanStaged(t *testing.T) {
+	defer testFS(t, "local")()
+	os.MkdirAll(WRITE_PATH, 0755)
+	ioutil.WriteFile(stagePath(5), []byte("lost"), 0644)
+	cleanStaged()
+	if _, err := os.Stat(stagePath(5)); err == nil {
+		t.Fatal("staged file left")
+	}
+}
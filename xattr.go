@@ -0,0 +1,147 @@
+package main
+
+import (
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"bazil.org/fuse"
+	"golang.org/x/net/context"
+)
+
+// Read only extended attributes telling where files are stored and how much
+// of them is cached, for scripts.
+const XATTR_PREFIX = "user.seeefs."
+
+var fileXattrs = []string{"sha512", "nodes", "cached", "dirty"}
+var dirXattrs = []string{"cached"}
+
+// fileRanges returns the ranges of nodes holding file i, as node id, offset
+// and length. FSMutex must be held.
+func fileRanges(i uint64) [][3]uint64 {
+	res := make([][3]uint64, 0)
+	if Files[i].Link != "" || Files[i].Size == 0 {
+		return res
+	}
+	s := Files[i].Storage
+	if len(s.Nodes) == 0 {
+		if s.NodeId == NullId {
+			return res
+		}
+		return append(res, [3]uint64{s.NodeId, s.NodePos, Files[i].Size})
+	}
+	for _, n := range s.Nodes {
+		if n < uint64(len(Nodes)) {
+			res = append(res, [3]uint64{n, 0, Nodes[n].Size})
+		}
+	}
+	return res
+}
+
+// cachedOf returns the cached bytes and the size of the files ids.
+func cachedOf(ids []uint64) (uint64, uint64) {
+	FSMutex.Lock()
+	ranges := make([][3]uint64, 0)
+	var size uint64 = 0
+	for _, i := range ids {
+		ranges = append(ranges, fileRanges(i)...)
+		size += Files[i].Size
+	}
+	FSMutex.Unlock()
+	var res uint64 = 0
+	CacheListMutex.Lock()
+	for _, r := range ranges {
+		if r[0] < uint64(len(NodesChunks)) {
+			res += cachedBytes(r[0], r[1], r[2])
+		}
+	}
+	CacheListMutex.Unlock()
+	return res, size
+}
+
+func fileXattr(id uint64, name string) (string, bool) {
+	switch name {
+	case "sha512":
+		FSMutex.Lock()
+		defer FSMutex.Unlock()
+		if Files[id].SHA512 == [sha512.Size]byte{} {
+			return "", false
+		}
+		return hex.EncodeToString(Files[id].SHA512[:]), true
+	case "nodes":
+		// one line per node: id, offset, length, sources separated by commas
+		// ("-" until it is uploaded) and SHA-256 of the whole node
+		FSMutex.Lock()
+		defer FSMutex.Unlock()
+		res := ""
+		for _, r := range fileRanges(id) {
+			if r[0] >= uint64(len(Nodes)) {
+				continue
+			}
+			res += fmt.Sprintf("%d %d %d %s %s\n", r[0], r[1], r[2], sourcesString(Nodes[r[0]]), hex.EncodeToString(Nodes[r[0]].Hash[:]))
+		}
+		return res, true
+	case "cached":
+		c, s := cachedOf([]uint64{id})
+		return strconv.FormatUint(c, 10) + "/" + strconv.FormatUint(s, 10), true
+	case "dirty":
+		DirtyMutex.Lock()
+		_, ok := DirtyFiles[id]
+		DirtyMutex.Unlock()
+		if ok {
+			return "1", true
+		}
+		return "0", true
+	}
+	return "", false
+}
+
+func (f FuseFile) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if !strings.HasPrefix(req.Name, XATTR_PREFIX) {
+		return fuse.ErrNoXattr
+	}
+	v, ok := fileXattr(f.Id, strings.TrimPrefix(req.Name, XATTR_PREFIX))
+	if !ok {
+		return fuse.ErrNoXattr
+	}
+	resp.Xattr = []byte(v)
+	return nil
+}
+
+func (f FuseFile) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	for _, t := range fileXattrs {
+		resp.Append(XATTR_PREFIX + t)
+	}
+	return nil
+}
+
+func (f FuseDir) Getxattr(ctx context.Context, req *fuse.GetxattrRequest, resp *fuse.GetxattrResponse) error {
+	if f.Id == 0 && strings.HasPrefix(req.Name, XATTR_PREFIX) {
+		if v, ok := rootXattr(strings.TrimPrefix(req.Name, XATTR_PREFIX)); ok {
+			resp.Xattr = []byte(v)
+			return nil
+		}
+	}
+	if req.Name != XATTR_PREFIX + "cached" {
+		return fuse.ErrNoXattr
+	}
+	// of every file below it
+	FSMutex.Lock()
+	ids := liveFiles(f.Id)
+	FSMutex.Unlock()
+	c, s := cachedOf(ids)
+	resp.Xattr = []byte(strconv.FormatUint(c, 10) + "/" + strconv.FormatUint(s, 10))
+	return nil
+}
+
+func (f FuseDir) Listxattr(ctx context.Context, req *fuse.ListxattrRequest, resp *fuse.ListxattrResponse) error {
+	for _, t := range dirXattrs {
+		resp.Append(XATTR_PREFIX + t)
+	}
+	if f.Id == 0 {
+		resp.Append(XATTR_PREFIX + "cache", XATTR_PREFIX + "quota")
+	}
+	return nil
+}